@@ -1,6 +1,8 @@
 package sgdstore
 
 import (
+	"math"
+
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anynet"
 	"github.com/unixpickle/anyvec"
@@ -13,6 +15,7 @@ type Activation int
 const (
 	Tanh Activation = iota
 	ReLU
+	Linear
 )
 
 // Forward applies the activation function in the forward
@@ -23,6 +26,8 @@ func (a Activation) Forward(in anydiff.Res) anydiff.Res {
 		return anydiff.Tanh(in)
 	case ReLU:
 		return anydiff.ClipPos(in)
+	case Linear:
+		return in
 	}
 	panic("unsupported activation")
 }
@@ -37,6 +42,21 @@ func (a Activation) Backward(out, upstream anydiff.Res) anydiff.Res {
 		mask := out.Output().Copy()
 		anyvec.GreaterThan(mask, mask.Creator().MakeNumeric(0))
 		return anydiff.Mul(upstream, anydiff.NewConst(mask))
+	case Linear:
+		return upstream
+	}
+	panic("unsupported activation")
+}
+
+// apply applies the activation function to a number.
+func (a Activation) apply(x float64) float64 {
+	switch a {
+	case Tanh:
+		return math.Tanh(x)
+	case ReLU:
+		return math.Max(0, x)
+	case Linear:
+		return x
 	}
 	panic("unsupported activation")
 }
@@ -48,6 +68,8 @@ func (a Activation) Layer() anynet.Layer {
 		return anynet.Tanh
 	case ReLU:
 		return anynet.ReLU
+	case Linear:
+		return anynet.Net{}
 	}
 	panic("unsupported activation")
 }
@@ -0,0 +1,225 @@
+package sgdstore
+
+import (
+	"github.com/unixpickle/anydiff"
+)
+
+const (
+	// haltEpsilon is the ACT threshold: a network halts
+	// once its halting probabilities sum to 1-haltEpsilon.
+	haltEpsilon = 0.01
+
+	// lossEpsilon prevents log(0) when computing halting
+	// probabilities from losses.
+	lossEpsilon = 1e-8
+)
+
+// TrainAdaptive is like Train, but it uses Adaptive
+// Computation Time to decide how many steps to take for
+// each network.
+//
+// After every step, the halting probability
+//
+//     sigmoid(sharpness * (logThreshold - log(loss)))
+//
+// is computed from each network's loss on the batch.
+// A network halts once its halting probabilities sum to
+// nearly 1, or once it has taken maxSteps steps.
+// Halted networks take no further steps while the other
+// networks keep training.
+// The resulting parameters are a weighted sum of the
+// parameters after each step, where the weights are the
+// halting probabilities (with the remainder R used for
+// the final step).
+//
+// The logThreshold argument should contain one value,
+// which is shared between all the networks.
+//
+// The result is [param1, param2, ..., ponder], where
+// ponder is the ponder cost N+R of each network.
+// The number of steps N taken by each network is also
+// returned.
+func (n *Net) TrainAdaptive(inBatch, target, stepSize, logThreshold anydiff.Res,
+	batchSize, maxSteps int, sharpness float64) (anydiff.MultiRes, []int) {
+	if stepSize.Output().Len() != n.Num {
+		panic("invalid stepSize length")
+	} else if logThreshold.Output().Len() != 1 {
+		panic("threshold must be a scalar")
+	} else if maxSteps < 1 {
+		panic("maxSteps must be positive")
+	}
+	a := &adaptiveTrainer{
+		BatchSize: batchSize,
+		MaxSteps:  maxSteps,
+		Sharpness: sharpness,
+		Sums:      make([]float64, n.Num),
+		Steps:     make([]int, n.Num),
+	}
+	ins := anydiff.Fuse(inBatch, target, stepSize, repeatVec(logThreshold, n.Num))
+	res := n.poolShared(func(n *Net) anydiff.MultiRes {
+		return anydiff.PoolMulti(ins, func(s []anydiff.Res) anydiff.MultiRes {
+			a.InBatch, a.Target, a.StepSize, a.LogThreshold = s[0], s[1], s[2], s[3]
+			return a.Step(n)
+		})
+	})
+	return res, a.Steps
+}
+
+// adaptiveTrainer implements Net.TrainAdaptive.
+type adaptiveTrainer struct {
+	InBatch      anydiff.Res
+	Target       anydiff.Res
+	StepSize     anydiff.Res
+	LogThreshold anydiff.Res
+
+	BatchSize int
+	MaxSteps  int
+	Sharpness float64
+
+	// Pooled parameters and halting probabilities from
+	// every step so far.
+	Params [][]anydiff.Res
+	Halts  []anydiff.Res
+
+	// Sums stores the cumulative halting probability for
+	// each network.
+	Sums []float64
+
+	// Steps stores the number of steps after which each
+	// network halted, or 0 for running networks.
+	Steps []int
+}
+
+// Step takes a step of SGD and continues recursively
+// until every network has halted.
+func (a *adaptiveTrainer) Step(n *Net) anydiff.MultiRes {
+	next := a.stepRunning(n)
+	return anydiff.PoolMulti(next.Parameters, func(params []anydiff.Res) anydiff.MultiRes {
+		net := n.withParameters(anydiff.Fuse(params...))
+		return anydiff.PoolFork(a.haltProbs(net), func(halt anydiff.Res) anydiff.MultiRes {
+			a.Params = append(a.Params, params)
+			a.Halts = append(a.Halts, halt)
+			numSteps := len(a.Halts)
+			var running bool
+			for i, prob := range vecFloats(halt.Output()) {
+				if a.Steps[i] != 0 {
+					continue
+				}
+				a.Sums[i] += prob
+				if a.Sums[i] >= 1-haltEpsilon || numSteps == a.MaxSteps {
+					a.Steps[i] = numSteps
+				} else {
+					running = true
+				}
+			}
+			if running {
+				return a.Step(net)
+			}
+			return a.mix()
+		})
+	})
+}
+
+// stepRunning takes a step of SGD for the networks which
+// have not halted.
+// The halted networks keep their parameters, since later
+// parameters do not contribute to the result.
+func (a *adaptiveTrainer) stepRunning(n *Net) *Net {
+	var running []int
+	for i, steps := range a.Steps {
+		if steps == 0 {
+			running = append(running, i)
+		}
+	}
+	if len(running) == n.Num {
+		return n.step(a.InBatch, a.Target, a.StepSize, a.BatchSize)
+	}
+	sub := n.selectNets(running)
+	next := sub.step(
+		selectChunks(a.InBatch, n.Num, running),
+		selectChunks(a.Target, n.Num, running),
+		selectChunks(a.StepSize, n.Num, running),
+		a.BatchSize,
+	)
+	if n.check != nil {
+		n.check.Step = sub.check.Step
+		if n.check.Err == nil {
+			n.check.Err = sub.check.Err
+		}
+	}
+	return n.withParameters(n.insertNets(next.Parameters, running))
+}
+
+func (a *adaptiveTrainer) haltProbs(n *Net) anydiff.Res {
+	c := a.Target.Output().Creator()
+	loss := n.Loss(a.InBatch, a.Target, a.BatchSize)
+	logLoss := anydiff.Log(anydiff.AddScalar(loss, c.MakeNumeric(lossEpsilon)))
+	logits := anydiff.Scale(anydiff.Sub(a.LogThreshold, logLoss), c.MakeNumeric(a.Sharpness))
+	return anydiff.Sigmoid(logits)
+}
+
+// mix produces [param1, param2, ..., ponder] once every
+// network has halted.
+func (a *adaptiveTrainer) mix() anydiff.MultiRes {
+	c := a.Target.Output().Creator()
+	num := len(a.Steps)
+
+	var runningMasks, lastMasks []anydiff.Res
+	var haltSum anydiff.Res
+	for k, halt := range a.Halts {
+		running := make([]float64, num)
+		last := make([]float64, num)
+		for i, steps := range a.Steps {
+			if k+1 < steps {
+				running[i] = 1
+			} else if k+1 == steps {
+				last[i] = 1
+			}
+		}
+		runningMask := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(running)))
+		runningMasks = append(runningMasks, runningMask)
+		lastMasks = append(lastMasks,
+			anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(last))))
+		haltSum = addOrSet(haltSum, anydiff.Mul(runningMask, halt))
+	}
+
+	return anydiff.PoolFork(anydiff.Complement(haltSum),
+		func(remainder anydiff.Res) anydiff.MultiRes {
+			probs := make([]anydiff.Res, len(a.Halts))
+			for k, halt := range a.Halts {
+				probs[k] = anydiff.Add(
+					anydiff.Mul(runningMasks[k], halt),
+					anydiff.Mul(lastMasks[k], remainder),
+				)
+			}
+
+			var res []anydiff.Res
+			for j := range a.Params[0] {
+				var sum anydiff.Res
+				for k, params := range a.Params {
+					mat := &anydiff.Matrix{
+						Data: params[j],
+						Rows: num,
+						Cols: params[j].Output().Len() / num,
+					}
+					sum = addOrSet(sum, anydiff.ScaleRows(mat, probs[k]).Data)
+				}
+				res = append(res, sum)
+			}
+
+			counts := make([]float64, num)
+			for i, steps := range a.Steps {
+				counts[i] = float64(steps)
+			}
+			countVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(counts)))
+			return anydiff.Fuse(append(res, anydiff.Add(countVec, remainder))...)
+		})
+}
+
+// addOrSet adds two results, treating a nil sum as 0.
+func addOrSet(sum, x anydiff.Res) anydiff.Res {
+	if sum == nil {
+		return x
+	}
+	return anydiff.Add(sum, x)
+}
@@ -1,8 +1,10 @@
 package sgdstore
 
 import (
+	"errors"
 	"fmt"
 	"math"
+	"math/rand"
 
 	"github.com/unixpickle/anydiff"
 	"github.com/unixpickle/anynet"
@@ -17,11 +19,74 @@ func init() {
 	serializer.RegisterTypedDeserializer((&Block{}).SerializerType(), DeserializeBlock)
 }
 
+// ReadMode specifies when a Block queries its memory
+// relative to writing to it.
+type ReadMode int
+
+// Supported read modes.
+const (
+	// ReadAfterWrite queries the updated network.
+	ReadAfterWrite ReadMode = iota
+
+	// ReadBeforeWrite queries the network before it is
+	// trained on the current timestep's examples.
+	ReadBeforeWrite
+
+	// ReadBeforeAndAfter queries the network both before
+	// and after the write, concatenating the results.
+	ReadBeforeAndAfter
+)
+
+// Aggregation specifies how a Block combines the outputs
+// of its queries in each read.
+type Aggregation int
+
+// Supported aggregations.
+const (
+	// ConcatQueries concatenates the outputs.
+	ConcatQueries Aggregation = iota
+
+	// MeanQueries averages the outputs.
+	MeanQueries
+
+	// MaxQueries computes the component-wise maximum of
+	// the outputs.
+	MaxQueries
+
+	// AttentionQueries computes a weighted average of the
+	// outputs, where the weights are a softmax of learned
+	// scores (see Block.QueryAttention).
+	AttentionQueries
+)
+
 // Block is an RNN block that uses a Net as its memory.
 type Block struct {
 	InitParams []*anydiff.Var
+
+	// Activation is the activation function of the
+	// storage network.
+	// It is used both for training and for reading, including
+	// reads after a write.
 	Activation Activation
 
+	// Conv, if non-nil, makes some of the storage
+	// network's layers convolutional.
+	// See Net.Conv.
+	Conv []*ConvLayer
+
+	// NormKeys, if true, normalizes the training inputs
+	// and queries of the storage network.
+	// See Net.NormKeys.
+	NormKeys bool
+
+	// Embedding, if true, makes the first layer of the
+	// storage network an embedding table addressed by soft
+	// one-hot keys, and EmbeddingTopK optionally limits
+	// the number of entries each key addresses.
+	// See Net.Embedding and EmbeddingBlock.
+	Embedding     bool
+	EmbeddingTopK int
+
 	// Gates which transform the input into various vectors
 	// used to train and query the current Net.
 	TrainInput  anynet.Layer
@@ -29,9 +94,447 @@ type Block struct {
 	StepSize    anynet.Layer
 	Query       anynet.Layer
 
+	// InitNet, if non-nil, is a hypernetwork which maps a
+	// context vector for each sequence to offsets for the
+	// initial parameters.
+	// Its output for each sequence is the concatenation of
+	// offsets for all of the InitParams.
+	// The contexts are passed to StartContext, or taken
+	// from the first inputs by a ContextBlock.
+	//
+	// The Reset gate and elastic regularization use the
+	// generated parameters of each sequence.
+	InitNet anynet.Layer
+
+	// Reset is an optional gate which produces one value
+	// per sequence, typically in the range [0, 1].
+	// Before each write, the storage network of every
+	// sequence is interpolated towards InitParams by the
+	// corresponding amount, so that a value of 1 restores
+	// the initial memory.
+	//
+	// If Reset is nil, the memory is never reset.
+	Reset anynet.Layer
+
+	// WriteGate is an optional gate which produces one
+	// value per sequence in the range [0, 1], typically
+	// with a sigmoid (see NewWriteGate).
+	// Every sequence's step size is multiplied by the
+	// corresponding value, so that a value of 0 disables
+	// the write.
+	// The rehearsal buffer is updated in the same way, so
+	// a sequence that does not write keeps its old buffer.
+	//
+	// WriteGate cannot be combined with Ridge, since the
+	// closed-form write does not use step sizes.
+	WriteGate anynet.Layer
+
+	// HardWrite, if true, rounds the outputs of WriteGate
+	// to 0 or 1, using the straight-through estimator for
+	// gradients.
+	// Sequences whose gates are closed skip Net.Train
+	// entirely, so closed gates receive no gradient from
+	// the write.
+	// This is mainly intended to save computation at
+	// inference time.
+	// With experts, ensembles, adaptive computation, or
+	// inner losses, closed sequences are trained with a
+	// step size of 0 rather than skipped.
+	HardWrite bool
+
+	// EraseGate is an optional gate which produces one
+	// value e in the range [0, 1] for every training
+	// example, typically with a sigmoid (see NewEraseGate).
+	// Each example's gradient is scaled by 1-2e, so that a
+	// value of 1 performs gradient ascent on the example,
+	// removing the binding from memory rather than storing
+	// it, and a value of 0.5 ignores the example.
+	// See Net.ExampleWeights.
+	//
+	// EraseGate cannot be combined with Experts, Ridge, or
+	// Rehearsal.
+	EraseGate anynet.Layer
+
 	// Steps is the number of SGD steps to take at each
 	// timestep.
 	Steps int
+
+	// StepSizeScale, if non-zero, scales the output of the
+	// StepSize gate.
+	// This makes it possible to change the step size at
+	// evaluation time without modifying the gate.
+	StepSizeScale float64
+
+	// GradClip, if non-zero, clips the norm of the storage
+	// network's gradient at every SGD step.
+	// See Net.GradClip.
+	GradClip float64
+
+	// Rehearsal, if non-zero, is the number of recently
+	// written examples to store for each sequence.
+	// The buffered examples are added to the training batch
+	// at every timestep, reducing the extent to which
+	// earlier writes are overwritten.
+	// Gradients flow through the buffer to the gates which
+	// produced the examples.
+	//
+	// Each sequence keeps track of how many examples its
+	// buffer holds, and empty slots are not trained on.
+	// The Reset gate clears the buffer along with the
+	// memory, so examples from before a reset are not
+	// rehearsed.
+	// Inner losses (see LossOutputs) are averaged over the
+	// real examples only.
+	Rehearsal int
+
+	// Elastic, if non-zero, is the coefficient λ of an
+	// inner loss term
+	//
+	//     λ*||θ - InitParams||^2
+	//
+	// which pulls the storage network back towards its
+	// initial parameters.
+	// See Net.Elastic.
+	Elastic float64
+
+	// ElasticGate, if non-nil, is a gate which produces
+	// one elastic coefficient per sequence.
+	// It overrides Elastic.
+	ElasticGate anynet.Layer
+
+	// Decay, if non-zero, is the coefficient of an L2
+	// penalty on the storage network's parameters.
+	// See Net.Decay.
+	Decay float64
+
+	// Subset, if non-zero, is the number of training
+	// examples to use at each SGD step, chosen randomly.
+	// See Net.Subset.
+	Subset int
+
+	// KeyDropout, if non-zero, is the dropout probability
+	// for the training inputs at each SGD step.
+	// See Net.KeyDropout.
+	KeyDropout float64
+
+	// Rand, if non-nil, is the source of randomness for
+	// Subset and KeyDropout.
+	// It is not serialized.
+	Rand *rand.Rand
+
+	// Experts, if non-zero, is the number of expert
+	// storage networks per sequence, turning the memory
+	// into a mixture of experts (see ExpertNet).
+	// In this case, InitParams contains the concatenated
+	// parameters of all the experts.
+	// Use SetExperts to enable this mode.
+	//
+	// Experts cannot be combined with Ridge, adaptive
+	// computation, inner losses, or elastic
+	// regularization.
+	Experts int
+
+	// TopK is the number of experts to which each key is
+	// routed, or 0 to route keys to all experts.
+	// See ExpertNet.TopK.
+	TopK int
+
+	// Router is the learned routing matrix for Experts.
+	Router *anydiff.Var
+
+	// Ensemble, if non-zero, is the number of storage
+	// networks per sequence in an ensemble memory.
+	// Every member is trained on the same writes, and each
+	// read is the average of the members' outputs.
+	// Like for Experts, InitParams contains the
+	// concatenated parameters of all the members.
+	// Use SetEnsemble to enable this mode.
+	//
+	// Ensemble has the same restrictions as Experts, and
+	// the two cannot be combined.
+	Ensemble int
+
+	// EnsembleVariance, if true, causes the output for
+	// each query of an ensemble memory to be followed by
+	// the variance of the members' outputs, averaged over
+	// the output components.
+	EnsembleVariance bool
+
+	// Ridge, if non-nil, enables a closed-form write.
+	// After the SGD steps, the final layer of the storage
+	// network is replaced with the solution to a ridge
+	// regression problem on the training examples
+	// (including any rehearsed examples).
+	// In this mode, the final layer is not followed by an
+	// activation function.
+	// Setting Steps to 0 freezes the hidden layers.
+	//
+	// Ridge is the logarithm of the regularization
+	// strength, a learned parameter with one component.
+	// The strength is clamped to at least MinRidge so that
+	// the regression problem has a unique solution.
+	// If the problem still cannot be solved, the final
+	// layer is set to zero and the problem is reported by
+	// the FiniteErr field of the resulting State.
+	Ridge *anydiff.Var
+
+	// ReadMode determines whether queries see the memory
+	// before the write, after the write, or both.
+	ReadMode ReadMode
+
+	// LossOutputs, if true, causes the block to append the
+	// storage network's loss on the training batch to the
+	// output of each sequence.
+	// There are Steps+1 losses per sequence: one before
+	// every SGD step and one after the final step.
+	LossOutputs bool
+
+	// Aggregation determines how the outputs of the
+	// queries are combined in each read.
+	// With any aggregation other than ConcatQueries, the
+	// size of a read does not depend on the query batch
+	// size.
+	Aggregation Aggregation
+
+	// QueryAttention is a learned vector for
+	// AttentionQueries.
+	// The score of each query is the dot product of this
+	// vector with the query's output (including any extra
+	// values from ReadLayers or EnsembleVariance).
+	// See SetAttention.
+	QueryAttention *anydiff.Var
+
+	// ReadLayers, if non-empty, contains the indices of
+	// storage network layers whose activations are
+	// included in every read.
+	// The output for each query is followed by the
+	// selected layers' outputs for that query, in the
+	// order of ReadLayers.
+	// This cannot be combined with Experts or Ensemble.
+	ReadLayers []int
+
+	// KeyDistance, if true, causes the block to append a
+	// confidence signal for every query to the output of
+	// each sequence: the squared Euclidean distance from
+	// the query to the nearest key the storage network was
+	// trained on at the current timestep, including any
+	// rehearsed keys.
+	// Small distances indicate that a query resembles
+	// something which was written to memory.
+	// The distances follow the read outputs and any
+	// LossOutputs.
+	KeyDistance bool
+
+	// LossPenalty, if non-zero, adds a penalty to the
+	// gradient as if the sum of all the inner losses
+	// (see LossOutputs), scaled by LossPenalty, were part
+	// of the outer cost.
+	//
+	// Since the penalty is added to every sequence, it may
+	// have to be divided by the batch size when the outer
+	// cost is averaged.
+	LossPenalty float64
+
+	// MaxSteps, if non-zero, enables adaptive computation.
+	// Rather than taking Steps steps, the block takes
+	// between 1 and MaxSteps steps for each sequence,
+	// stopping once the inner loss falls below a learned
+	// threshold (see Net.TrainAdaptive).
+	// The number of steps taken for each sequence is
+	// recorded in the resulting State's Steps.
+	//
+	// Adaptive computation cannot be combined with
+	// LossOutputs or LossPenalty.
+	MaxSteps int
+
+	// HaltThreshold is the logarithm of the inner loss
+	// threshold for adaptive computation.
+	// It is a learned parameter with one component.
+	HaltThreshold *anydiff.Var
+
+	// HaltSharpness scales the logits of the halting
+	// probabilities.
+	// If it is 0, DefaultHaltSharpness is used.
+	HaltSharpness float64
+
+	// PonderCost is the weight of each sequence's ponder
+	// cost N+R in the gradient, analogous to LossPenalty.
+	// Higher values encourage fewer steps.
+	PonderCost float64
+
+	// CheckFinite, if true, causes the block to check the
+	// step sizes, inner gradients, and updated parameters
+	// for NaNs and infinities at every timestep.
+	// The first problem at each timestep is reported by
+	// the FiniteErr field of the resulting State.
+	// It is not serialized.
+	CheckFinite bool
+}
+
+// DefaultHaltSharpness is the default value for
+// Block.HaltSharpness.
+const DefaultHaltSharpness = 5
+
+// SetAdaptive enables adaptive computation with the given
+// maximum number of steps and initial loss threshold.
+//
+// If the block's other options do not support adaptive
+// computation, an error is returned and b is unchanged.
+func (b *Block) SetAdaptive(c anyvec.Creator, maxSteps int, threshold float64) error {
+	res := *b
+	res.MaxSteps = maxSteps
+	logThreshold := c.MakeNumericList([]float64{math.Log(threshold)})
+	res.HaltThreshold = anydiff.NewVar(c.MakeVectorData(logThreshold))
+	return b.update(&res)
+}
+
+// MinRidge is the smallest regularization strength used
+// for the closed-form write.
+// See Block.Ridge.
+const MinRidge = 1e-6
+
+// SetRidge enables the closed-form write with the given
+// initial regularization strength.
+//
+// If the block's other options do not support ridge
+// regression, an error is returned and b is unchanged.
+func (b *Block) SetRidge(c anyvec.Creator, lambda float64) error {
+	res := *b
+	logLambda := c.MakeNumericList([]float64{math.Log(lambda)})
+	res.Ridge = anydiff.NewVar(c.MakeVectorData(logLambda))
+	return b.update(&res)
+}
+
+// TieKeys replaces the Query gate with a TiedFC that
+// shares the weights of the TrainInput gate, so that
+// queries and training inputs are computed by the same
+// projection.
+// Both gates must be *anynet.FC layers, and the query
+// batch must not be larger than the training batch.
+//
+// If separateBiases is true, the Query gate keeps its own
+// biases.
+// Otherwise, the biases are shared as well.
+func (b *Block) TieKeys(separateBiases bool) {
+	trainIn, ok1 := b.TrainInput.(*anynet.FC)
+	query, ok2 := b.Query.(*anynet.FC)
+	if !ok1 || !ok2 {
+		panic("tied keys require fully-connected gates")
+	} else if query.OutCount > trainIn.OutCount || query.InCount != trainIn.InCount {
+		panic("query gate does not fit in training gate")
+	}
+	tied := &TiedFC{FC: trainIn, OutCount: query.OutCount}
+	if separateBiases {
+		tied.Biases = query.Biases
+	}
+	b.Query = tied
+}
+
+// SetAttention enables AttentionQueries with an initial
+// attention vector of zeros, which weights every query
+// equally.
+//
+// The rowSize is the size of the output for each query.
+func (b *Block) SetAttention(c anyvec.Creator, rowSize int) {
+	b.Aggregation = AttentionQueries
+	b.QueryAttention = anydiff.NewVar(c.MakeVector(rowSize))
+}
+
+// SetExperts turns the storage network into a mixture of
+// the given number of experts, each of which has the
+// current storage network's architecture.
+// The experts are initialized with init and the routing
+// matrix is random.
+//
+// If the block's other options do not support experts,
+// an error is returned and b is unchanged.
+//
+// See Block.Experts and Block.TopK.
+func (b *Block) SetExperts(c anyvec.Creator, init Initializer, experts, topK int) error {
+	res := *b
+	keySize := res.replicateParams(c, init, experts)
+	res.Experts = experts
+	res.TopK = topK
+	res.Router = NewRouter(c, experts, keySize)
+	return b.update(&res)
+}
+
+// SetEnsemble turns the storage network into an ensemble
+// of the given number of members, each of which has the
+// current storage network's architecture and is
+// initialized independently with init.
+//
+// If the block's other options do not support ensembles,
+// an error is returned and b is unchanged.
+//
+// See Block.Ensemble and Block.EnsembleVariance.
+func (b *Block) SetEnsemble(c anyvec.Creator, init Initializer, members int,
+	variance bool) error {
+	res := *b
+	res.replicateParams(c, init, members)
+	res.Ensemble = members
+	res.EnsembleVariance = variance
+	return b.update(&res)
+}
+
+// update replaces b with res if res is valid.
+func (b *Block) update(res *Block) error {
+	if err := res.validate(); err != nil {
+		return err
+	}
+	*b = *res
+	return nil
+}
+
+// validate checks that the block's options can be used
+// together.
+func (b *Block) validate() error {
+	if b.Experts != 0 || b.Ensemble != 0 {
+		if b.Experts != 0 && b.Ensemble != 0 {
+			return errors.New("experts and ensembles cannot be combined")
+		} else if b.Ridge != nil || b.MaxSteps != 0 || b.computeLosses() ||
+			b.Elastic != 0 || b.ElasticGate != nil || len(b.ReadLayers) > 0 {
+			return errors.New("unsupported options for experts or ensemble")
+		}
+	}
+	if b.WriteGate != nil && b.Ridge != nil {
+		return errors.New("write gate is not supported with ridge regression")
+	}
+	if b.MaxSteps != 0 && b.computeLosses() {
+		return errors.New("inner losses are not supported with adaptive computation")
+	}
+	if b.EraseGate != nil && (b.Experts != 0 || b.Ridge != nil || b.Rehearsal != 0) {
+		return errors.New("erase gate is not supported with experts, " +
+			"ridge regression, or rehearsal")
+	}
+	return nil
+}
+
+// replicateParams replaces InitParams with the
+// concatenated parameters of count new networks of the
+// same architecture.
+// It returns the storage network's input size.
+func (b *Block) replicateParams(c anyvec.Creator, init Initializer, count int) int {
+	if b.Experts != 0 || b.Ensemble != 0 {
+		panic("storage network is already replicated")
+	}
+	keySize := b.keySize()
+	newParams := make([]*anydiff.Var, len(b.InitParams))
+	for i := 0; i < len(b.InitParams); i += 2 {
+		outSize := b.InitParams[i+1].Vector.Len()
+		inSize := b.InitParams[i].Vector.Len() / outSize
+		var weights, biases []anyvec.Vector
+		for j := 0; j < count; j++ {
+			last := i+2 == len(b.InitParams)
+			w, bias := init.InitLayer(c, inSize, outSize, last)
+			weights = append(weights, w)
+			biases = append(biases, bias)
+		}
+		newParams[i] = anydiff.NewVar(c.Concat(weights...))
+		newParams[i+1] = anydiff.NewVar(c.Concat(biases...))
+	}
+	b.InitParams = newParams
+	return keySize
 }
 
 // LinearBlock creates a Block with linear gates.
@@ -58,37 +561,198 @@ type Block struct {
 //
 //     queryBatch * layerSizes[len(layerSizes)-1]
 //
+// This changes if ReadMode, Aggregation, ReadLayers,
+// LossOutputs, or KeyDistance are modified.
+//
+// The storage network is initialized with DefaultInit.
+// See LinearBlockInit for other initialization schemes.
 func LinearBlock(c anyvec.Creator, blockIn, trainBatch, queryBatch, numSteps int,
 	lrBias float64, activation Activation, layerSizes ...int) *Block {
+	return LinearBlockInit(c, blockIn, trainBatch, queryBatch, numSteps, lrBias,
+		activation, DefaultInit{}, layerSizes...)
+}
+
+// LinearBlockInit is like LinearBlock, but it uses the
+// given Initializer for the storage network.
+func LinearBlockInit(c anyvec.Creator, blockIn, trainBatch, queryBatch, numSteps int,
+	lrBias float64, activation Activation, init Initializer,
+	layerSizes ...int) *Block {
 	if len(layerSizes) < 2 {
 		panic("not enough layer sizes")
 	} else if trainBatch < 1 || queryBatch < 1 {
 		panic("invalid batch size")
 	}
 
-	res := &Block{
-		TrainInput: anynet.NewFC(c, blockIn, trainBatch*layerSizes[0]),
+	res := linearGates(c, blockIn, trainBatch, queryBatch, numSteps, lrBias, activation,
+		layerSizes[0], layerSizes[len(layerSizes)-1])
+	res.InitParams = NewStorageParams(c, init, layerSizes...)
+	return res
+}
+
+// ConvBlock creates a Block with linear gates whose
+// storage network begins with convolutional layers.
+//
+// The i-th convolutional layer is described by convs[i]
+// and has depths[i] output channels.
+// Each layer's input must match the previous layer's
+// output image.
+// The keys produced by the TrainInput and Query gates are
+// images of the size expected by convs[0].
+//
+// The convolutional layers are followed by
+// fully-connected layers with the given layerSizes,
+// which (unlike for LinearBlock) do not include an input
+// size.
+// If there are no layerSizes, the output of the final
+// convolutional layer is the network's output.
+//
+// The other arguments are like those of LinearBlock.
+func ConvBlock(c anyvec.Creator, blockIn, trainBatch, queryBatch, numSteps int,
+	lrBias float64, activation Activation, convs []*ConvLayer, depths []int,
+	layerSizes ...int) *Block {
+	if len(convs) == 0 || len(convs) != len(depths) {
+		panic("need one depth per convolutional layer")
+	} else if trainBatch < 1 || queryBatch < 1 {
+		panic("invalid batch size")
+	}
+	var params []*anydiff.Var
+	var init DefaultInit
+	for i, conv := range convs {
+		if i > 0 {
+			prev := convs[i-1]
+			if conv.InWidth != prev.OutWidth() || conv.InHeight != prev.OutHeight() ||
+				conv.InDepth != depths[i-1] {
+				panic("mismatching convolutional layer sizes")
+			}
+		}
+		last := i+1 == len(convs) && len(layerSizes) == 0
+		weights, biases := init.InitLayer(c, conv.FilterSize(), depths[i], last)
+		params = append(params, anydiff.NewVar(weights), anydiff.NewVar(biases))
+	}
+	lastConv := convs[len(convs)-1]
+	outSize := lastConv.NumPatches() * depths[len(depths)-1]
+	if len(layerSizes) > 0 {
+		fcSizes := append([]int{outSize}, layerSizes...)
+		params = append(params, NewStorageParams(c, init, fcSizes...)...)
+		outSize = layerSizes[len(layerSizes)-1]
+	}
+
+	res := linearGates(c, blockIn, trainBatch, queryBatch, numSteps, lrBias, activation,
+		convs[0].InSize(), outSize)
+	res.InitParams = params
+	res.Conv = convs
+	return res
+}
+
+// EmbeddingBlock creates a Block whose storage network
+// begins with an embedding table of numSymbols entries
+// (see Net.Embedding).
+//
+// The TrainInput and Query gates are linear layers
+// followed by a softmax over the symbols for each key,
+// so that every key is a soft one-hot vector.
+// If topK is non-zero, each key only addresses its topK
+// most likely symbols.
+//
+// The layerSizes start with the size of an embedding
+// and end with the network's output size, so there must
+// be at least two of them.
+// The other arguments are like those of LinearBlock.
+func EmbeddingBlock(c anyvec.Creator, blockIn, trainBatch, queryBatch, numSteps int,
+	lrBias float64, activation Activation, numSymbols, topK int,
+	layerSizes ...int) *Block {
+	if len(layerSizes) < 2 {
+		panic("not enough layer sizes")
+	} else if trainBatch < 1 || queryBatch < 1 {
+		panic("invalid batch size")
+	}
+	res := linearGates(c, blockIn, trainBatch, queryBatch, numSteps, lrBias, activation,
+		numSymbols, layerSizes[len(layerSizes)-1])
+	res.TrainInput = anynet.Net{res.TrainInput, &Softmax{ChunkSize: numSymbols}}
+	res.Query = anynet.Net{res.Query, &Softmax{ChunkSize: numSymbols}}
+
+	// Give the entries unit variance, rather than scaling
+	// them down by the (typically large) number of symbols
+	// like ordinary weights.
+	res.InitParams = NewStorageParams(c, DefaultInit{},
+		append([]int{numSymbols}, layerSizes...)...)
+	table := res.InitParams[0].Vector
+	table.Scale(c.MakeNumeric(math.Sqrt(float64(numSymbols))))
+
+	res.Embedding = true
+	res.EmbeddingTopK = topK
+	return res
+}
+
+// linearGates creates a Block with linear gates for a
+// storage network with the given input and output sizes.
+// The caller must set the initial parameters.
+func linearGates(c anyvec.Creator, blockIn, trainBatch, queryBatch, numSteps int,
+	lrBias float64, activation Activation, inSize, outSize int) *Block {
+	return &Block{
+		TrainInput: anynet.NewFC(c, blockIn, trainBatch*inSize),
 		TrainTarget: anynet.Net{
-			anynet.NewFC(c, blockIn, trainBatch*layerSizes[len(layerSizes)-1]),
+			anynet.NewFC(c, blockIn, trainBatch*outSize),
 			activation.Layer(),
 		},
 		StepSize: anynet.Net{
 			anynet.NewFC(c, blockIn, 1).AddBias(c.MakeNumeric(math.Log(lrBias))),
 			anynet.Exp,
 		},
-		Query:      anynet.NewFC(c, blockIn, queryBatch*layerSizes[0]),
+		Query:      anynet.NewFC(c, blockIn, queryBatch*inSize),
 		Steps:      numSteps,
 		Activation: activation,
 	}
+}
 
-	layerSize := layerSizes[0]
-	for _, size := range layerSizes[1:] {
-		fc := anynet.NewFC(c, layerSize, size)
-		layerSize = size
-		res.InitParams = append(res.InitParams, fc.Parameters()...)
+// BoundedStepSize creates a StepSize gate which computes
+// step sizes between 0 and a learned maximum, as opposed
+// to the unbounded exponential used by LinearBlock.
+//
+// The initial maximum is given by maxStep, and the bias
+// is chosen so that the initial step size is roughly
+// initStep, which must be smaller than maxStep.
+func BoundedStepSize(c anyvec.Creator, blockIn int, initStep, maxStep float64) anynet.Layer {
+	if initStep <= 0 || initStep >= maxStep {
+		panic("initial step size must be between 0 and the maximum")
+	}
+	bias := math.Log(initStep / (maxStep - initStep))
+	return anynet.Net{
+		anynet.NewFC(c, blockIn, 1).AddBias(c.MakeNumeric(bias)),
+		NewScaledSigmoid(c, maxStep),
 	}
+}
 
-	return res
+// NewWriteGate creates a WriteGate which applies a
+// sigmoid to a linear function of the block's input.
+// The bias is chosen so that the gate's initial output
+// is roughly initOpen, which must be between 0 and 1.
+func NewWriteGate(c anyvec.Creator, blockIn int, initOpen float64) anynet.Layer {
+	if initOpen <= 0 || initOpen >= 1 {
+		panic("initial gate value must be between 0 and 1")
+	}
+	bias := math.Log(initOpen / (1 - initOpen))
+	return anynet.Net{
+		anynet.NewFC(c, blockIn, 1).AddBias(c.MakeNumeric(bias)),
+		anynet.Sigmoid,
+	}
+}
+
+// NewEraseGate creates an EraseGate which applies a
+// sigmoid to a linear function of the block's input,
+// producing one value per training example.
+// The bias is chosen so that the gate's initial outputs
+// are roughly initErase, which must be between 0 and 1.
+func NewEraseGate(c anyvec.Creator, blockIn, trainBatch int,
+	initErase float64) anynet.Layer {
+	if initErase <= 0 || initErase >= 1 {
+		panic("initial gate value must be between 0 and 1")
+	}
+	bias := math.Log(initErase / (1 - initErase))
+	return anynet.Net{
+		anynet.NewFC(c, blockIn, trainBatch).AddBias(c.MakeNumeric(bias)),
+		anynet.Sigmoid,
+	}
 }
 
 // DeserializeBlock deserializes a Block.
@@ -96,8 +760,15 @@ func DeserializeBlock(d []byte) (block *Block, err error) {
 	defer essentials.AddCtxTo("deserialize sgdstore.Block", &err)
 	var vecData []byte
 	block = &Block{}
+	var optData []byte
 	err = serializer.DeserializeAny(d, &vecData, &block.TrainInput, &block.TrainTarget,
-		&block.StepSize, &block.Query, &block.Steps)
+		&block.StepSize, &block.Query, &block.Steps, &optData)
+	if err != nil {
+		// Blocks saved before options were introduced.
+		optData = nil
+		err = serializer.DeserializeAny(d, &vecData, &block.TrainInput, &block.TrainTarget,
+			&block.StepSize, &block.Query, &block.Steps)
+	}
 	if err != nil {
 		return nil, err
 	}
@@ -112,21 +783,145 @@ func DeserializeBlock(d []byte) (block *Block, err error) {
 			return nil, fmt.Errorf("expected vector but got %T", vecObj)
 		}
 	}
+	if optData != nil {
+		if err := deserializeOptions(optData, block.setOption); err != nil {
+			return nil, err
+		}
+	}
+	if tied, ok := block.Query.(*TiedFC); ok {
+		trainIn, ok := block.TrainInput.(*anynet.FC)
+		if !ok {
+			return nil, fmt.Errorf("tied query gate requires *anynet.FC but got %T",
+				block.TrainInput)
+		}
+		tied.FC = trainIn
+	}
+	if err := block.validate(); err != nil {
+		return nil, err
+	}
 	return
 }
 
-// Start produces a start state.
+// Start produces a start state from InitParams.
+//
+// To generate the initial parameters with InitNet, use
+// StartContext or a ContextBlock instead.
 func (b *Block) Start(n int) anyrnn.State {
 	res := &State{Params: make([]*anyrnn.VecState, len(b.InitParams))}
 	for i, p := range b.InitParams {
 		res.Params[i] = anyrnn.NewVecState(p.Vector, n)
 	}
+	res.Buffer, res.BufferCounts = b.startBuffer(n)
+	return res
+}
+
+// StartContext produces a start state using InitNet to
+// generate initial parameters from a context vector for
+// each sequence, such as the first inputs of the
+// sequences or task embeddings.
+//
+// Gradients flow through ctx and InitNet in
+// PropagateStart.
+func (b *Block) StartContext(ctx anydiff.Res, n int) anyrnn.State {
+	if b.InitNet == nil {
+		panic("cannot use context without InitNet")
+	}
+	var totalSize int
+	for _, p := range b.InitParams {
+		totalSize += p.Vector.Len()
+	}
+	offsets := b.InitNet.Apply(ctx, n)
+	if offsets.Output().Len() != totalSize*n {
+		panic("InitNet must produce one offset per parameter")
+	}
+	start := anydiff.PoolFork(offsets, func(offsets anydiff.Res) anydiff.MultiRes {
+		var params []anydiff.Res
+		var idx int
+		for _, p := range b.InitParams {
+			var chunks []anydiff.Res
+			for _, seqOffsets := range splitVec(offsets, n) {
+				chunks = append(chunks, anydiff.Slice(seqOffsets, idx, idx+p.Vector.Len()))
+			}
+			idx += p.Vector.Len()
+			params = append(params, anydiff.Add(repeatVec(p, n), anydiff.Concat(chunks...)))
+		}
+		return anydiff.Fuse(params...)
+	})
+
+	present := make(anyrnn.PresentMap, n)
+	for i := range present {
+		present[i] = true
+	}
+	res := &State{start: start}
+	for _, vec := range start.Outputs() {
+		res.Params = append(res.Params, &anyrnn.VecState{
+			PresentMap: present,
+			Vector:     vec,
+		})
+		res.Origin = append(res.Origin, &anyrnn.VecState{
+			PresentMap: present,
+			Vector:     vec,
+		})
+	}
+	res.Buffer, res.BufferCounts = b.startBuffer(n)
 	return res
 }
 
+// startBuffer creates an empty rehearsal buffer and the
+// corresponding example counts, if the block uses a
+// rehearsal buffer.
+func (b *Block) startBuffer(n int) (buffer []*anyrnn.VecState, counts []int) {
+	if b.Rehearsal == 0 {
+		return nil, nil
+	}
+	c := b.InitParams[0].Vector.Creator()
+	for _, size := range []int{b.keySize(), b.valueSize()} {
+		empty := c.MakeVector(b.Rehearsal * size)
+		buffer = append(buffer, anyrnn.NewVecState(empty, n))
+	}
+	return buffer, make([]int, n)
+}
+
+// keySize returns the input size of a storage network.
+func (b *Block) keySize() int {
+	if len(b.Conv) > 0 && b.Conv[0] != nil {
+		return b.Conv[0].InSize()
+	}
+	return b.InitParams[0].Vector.Len() / b.InitParams[1].Vector.Len()
+}
+
+// valueSize returns the output size of a single storage
+// network, even if InitParams contains the parameters of
+// several experts or ensemble members.
+func (b *Block) valueSize() int {
+	numNets := b.Experts + b.Ensemble
+	if numNets == 0 {
+		numNets = 1
+	}
+	size := b.InitParams[len(b.InitParams)-1].Vector.Len() / numNets
+	lastLayer := len(b.InitParams)/2 - 1
+	if lastLayer < len(b.Conv) && b.Conv[lastLayer] != nil {
+		size *= b.Conv[lastLayer].NumPatches()
+	}
+	return size
+}
+
 // PropagateStart propagates through the start state.
 func (b *Block) PropagateStart(s anyrnn.StateGrad, g anydiff.Grad) {
 	state := s.(*State)
+	if state.start != nil {
+		if g.Intersects(state.start.Vars()) {
+			upstream := make([]anyvec.Vector, len(state.Params))
+			for i, vec := range state.Params {
+				upstream[i] = vec.Vector.Copy()
+				if i < len(state.Origin) {
+					upstream[i].Add(state.Origin[i].Vector)
+				}
+			}
+			state.start.Propagate(upstream, g)
+		}
+		return
+	}
 	for i, paramVar := range b.InitParams {
 		state.Params[i].PropagateStart(paramVar, g)
 	}
@@ -134,62 +929,100 @@ func (b *Block) PropagateStart(s anyrnn.StateGrad, g anydiff.Grad) {
 
 // Step evaluates the block.
 func (b *Block) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
-	state := s.(*State)
+	return b.step(s.(*State), in, nil)
+}
+
+// step evaluates the block.
+// If query is non-nil, it is used in place of the output
+// of the Query gate, allowing a caller to share the
+// queries with another memory.
+func (b *Block) step(state *State, in anyvec.Vector, query anydiff.Res) *blockRes {
 	inPool := anydiff.NewVar(in)
-	netPool := state.pool()
+	statePool := state.pool()
 	present := state.Present()
 	n := present.NumPresent()
-	gateOuts := b.applyGates(inPool, n)
+	gateOuts := b.applyGates(inPool, n, query)
+
+	info := &stepInfo{N: n, Timestep: state.Timestep, BufferCounts: state.BufferCounts}
+	for i, pres := range present {
+		if pres {
+			info.Sequences = append(info.Sequences, i)
+		}
+	}
+	if b.CheckFinite {
+		info.Check = &finiteChecker{Timestep: state.Timestep, Sequences: info.Sequences}
+	}
+	numParams := len(state.Params)
+	numBuffer := len(state.Buffer)
 
 	allRes := anydiff.PoolMulti(gateOuts, func(gateOuts []anydiff.Res) anydiff.MultiRes {
-		poolReses := make([]anydiff.Res, len(netPool))
-		for i, x := range netPool {
+		gates := b.gateValues(gateOuts)
+		poolReses := make([]anydiff.Res, len(statePool))
+		for i, x := range statePool {
 			poolReses[i] = x
 		}
-		net := &Net{
-			Parameters: anydiff.Fuse(poolReses...),
-			Num:        n,
-			Activation: b.Activation,
-		}
-		batchSize := gateOuts[0].Output().Len() / (net.InSize() * n)
-		newNet := net.Train(gateOuts[0], gateOuts[1], gateOuts[2], batchSize, b.Steps)
-		return anydiff.PoolMulti(newNet.Parameters,
-			func(newParams []anydiff.Res) anydiff.MultiRes {
-				net1 := *newNet
-				net1.Parameters = anydiff.Fuse(newParams...)
-				batchSize := gateOuts[3].Output().Len() / (net.InSize() * n)
-				applied := newNet.Apply(gateOuts[3], batchSize)
-				newReses := append([]anydiff.Res{applied}, newParams...)
-				return anydiff.Fuse(newReses...)
+		params := poolReses[:numParams]
+		buffer := poolReses[numParams : numParams+numBuffer]
+		origin := poolReses[numParams+numBuffer:]
+		if b.Reset != nil {
+			params = b.reset(params, origin, gates.Reset, n)
+			buffer, info.BufferCounts = b.resetBuffer(buffer, info.BufferCounts,
+				gates.Reset, n)
+		}
+		poolReses = append(append(append([]anydiff.Res{}, params...), buffer...), origin...)
+		return anydiff.PoolMulti(anydiff.Fuse(poolReses...),
+			func(pooled []anydiff.Res) anydiff.MultiRes {
+				return b.readWrite(pooled[:numParams], pooled[numParams:numParams+numBuffer],
+					pooled[numParams+numBuffer:], gates, info)
 			})
 	})
-
-	newState := &State{
-		Params: make([]*anyrnn.VecState, len(state.Params)),
-	}
-	for i, newVec := range allRes.Outputs()[1:] {
-		newState.Params[i] = &anyrnn.VecState{
-			PresentMap: state.Params[i].PresentMap,
+	var newVecs []*anyrnn.VecState
+	for _, newVec := range allRes.Outputs()[1 : 1+len(statePool)] {
+		newVecs = append(newVecs, &anyrnn.VecState{
+			PresentMap: present,
 			Vector:     newVec,
-		}
+		})
+	}
+	newState := state.withVecs(newVecs)
+	newState.Timestep++
+	newState.Steps = info.Steps
+	newState.BufferCounts = info.BufferCounts
+	newState.FiniteErr = info.SolveErr
+	if info.Check != nil && info.Check.Err != nil {
+		newState.FiniteErr = info.Check.Err
 	}
 	v := anydiff.NewVarSet(b.Parameters()...)
 
 	return &blockRes{
-		InPool:   inPool,
-		NetPools: netPool,
-		OutVec:   allRes.Outputs()[0],
-		OutState: newState,
-		AllRes:   allRes,
-		V:        v,
+		InPool:     inPool,
+		StatePools: statePool,
+		OutVec:     allRes.Outputs()[0],
+		OutState:   newState,
+		AllRes:     allRes,
+		V:          v,
+		Penalties:  b.penalties(),
 	}
 }
 
 // Parameters returns the block's parameters, including
 // the parameters of the gates.
 func (b *Block) Parameters() []*anydiff.Var {
-	gateParams := anynet.AllParameters(b.TrainInput, b.TrainTarget, b.StepSize, b.Query)
-	return append(gateParams, b.InitParams...)
+	gateParams := anynet.AllParameters(b.TrainInput, b.TrainTarget, b.StepSize, b.Query,
+		b.Reset, b.ElasticGate, b.WriteGate, b.EraseGate, b.InitNet)
+	res := append(gateParams, b.InitParams...)
+	if b.HaltThreshold != nil {
+		res = append(res, b.HaltThreshold)
+	}
+	if b.Ridge != nil {
+		res = append(res, b.Ridge)
+	}
+	if b.Router != nil {
+		res = append(res, b.Router)
+	}
+	if b.QueryAttention != nil {
+		res = append(res, b.QueryAttention)
+	}
+	return res
 }
 
 // SerializerType returns the unique ID used to serialize
@@ -208,6 +1041,10 @@ func (b *Block) Serialize() ([]byte, error) {
 	if err != nil {
 		return nil, err
 	}
+	optData, err := serializeOptions(b.options())
+	if err != nil {
+		return nil, err
+	}
 	return serializer.SerializeAny(
 		serializer.Bytes(vecData),
 		b.TrainInput,
@@ -215,26 +1052,1189 @@ func (b *Block) Serialize() ([]byte, error) {
 		b.StepSize,
 		b.Query,
 		b.Steps,
+		serializer.Bytes(optData),
 	)
 }
 
-// applyGates returns a vector of the form:
-//
-//     [trainIn, trainTarget, step, query]
-//
-func (b *Block) applyGates(x anydiff.Res, n int) anydiff.MultiRes {
-	gates := []anynet.Layer{b.TrainInput, b.TrainTarget, b.StepSize, b.Query}
-	var outs []anydiff.Res
+// serializeOptions encodes the optional fields of a
+// block as a list of named entries, so that adding new
+// options does not break existing models.
+func serializeOptions(opts []blockOption) ([]byte, error) {
+	var entries []serializer.Serializer
+	for _, opt := range opts {
+		data, err := serializer.SerializeAny(opt.Fields...)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, serializer.Bytes(opt.Name), serializer.Bytes(data))
+	}
+	return serializer.SerializeSlice(entries)
+}
+
+// deserializeOptions decodes the result of
+// serializeOptions, passing each option to setOption.
+func deserializeOptions(d []byte, setOption func(name string, data []byte) error) error {
+	entries, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return err
+	}
+	if len(entries)%2 != 0 {
+		return errors.New("odd number of option entries")
+	}
+	for i := 0; i < len(entries); i += 2 {
+		name, ok1 := entries[i].(serializer.Bytes)
+		data, ok2 := entries[i+1].(serializer.Bytes)
+		if !ok1 || !ok2 {
+			return errors.New("invalid option entry")
+		}
+		if err := setOption(string(name), data); err != nil {
+			return essentials.AddCtx("option "+string(name), err)
+		}
+	}
+	return nil
+}
+
+type blockOption struct {
+	Name   string
+	Fields []interface{}
+}
+
+// encodeInts encodes a list of integers as a single
+// option field.
+func encodeInts(ints []int) serializer.Bytes {
+	var objs []serializer.Serializer
+	for _, x := range ints {
+		objs = append(objs, serializer.Int(x))
+	}
+	data, err := serializer.SerializeSlice(objs)
+	if err != nil {
+		// Serializing integers cannot fail.
+		panic(err)
+	}
+	return serializer.Bytes(data)
+}
+
+// decodeInts decodes an option whose only field was
+// produced by encodeInts.
+func decodeInts(data []byte) ([]int, error) {
+	var listData []byte
+	if err := serializer.DeserializeAny(data, &listData); err != nil {
+		return nil, err
+	}
+	objs, err := serializer.DeserializeSlice(listData)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]int, len(objs))
+	for i, obj := range objs {
+		x, ok := obj.(serializer.Int)
+		if !ok {
+			return nil, fmt.Errorf("expected int but got %T", obj)
+		}
+		res[i] = int(x)
+	}
+	return res, nil
+}
+
+// options returns the optional fields which differ from
+// their defaults.
+// Boolean options are stored without fields, since their
+// presence indicates that they are set.
+func (b *Block) options() []blockOption {
+	var res []blockOption
+	if b.Activation != Tanh {
+		res = append(res, blockOption{"activation", []interface{}{int(b.Activation)}})
+	}
+	if b.Conv != nil {
+		res = append(res, blockOption{"conv", []interface{}{
+			encodeInts(convLayerInts(b.Conv)),
+		}})
+	}
+	if b.NormKeys {
+		res = append(res, blockOption{"normKeys", nil})
+	}
+	if b.Embedding {
+		res = append(res, blockOption{"embedding", []interface{}{b.EmbeddingTopK}})
+	}
+	if b.InitNet != nil {
+		res = append(res, blockOption{"initNet", []interface{}{b.InitNet}})
+	}
+	if b.Reset != nil {
+		res = append(res, blockOption{"reset", []interface{}{b.Reset}})
+	}
+	if b.WriteGate != nil {
+		res = append(res, blockOption{"writeGate", []interface{}{b.WriteGate}})
+	}
+	if b.HardWrite {
+		res = append(res, blockOption{"hardWrite", nil})
+	}
+	if b.EraseGate != nil {
+		res = append(res, blockOption{"eraseGate", []interface{}{b.EraseGate}})
+	}
+	if b.StepSizeScale != 0 {
+		res = append(res, blockOption{"stepSizeScale", []interface{}{b.StepSizeScale}})
+	}
+	if b.GradClip != 0 {
+		res = append(res, blockOption{"gradClip", []interface{}{b.GradClip}})
+	}
+	if b.Elastic != 0 {
+		res = append(res, blockOption{"elastic", []interface{}{b.Elastic}})
+	}
+	if b.ElasticGate != nil {
+		res = append(res, blockOption{"elasticGate", []interface{}{b.ElasticGate}})
+	}
+	if b.Decay != 0 {
+		res = append(res, blockOption{"decay", []interface{}{b.Decay}})
+	}
+	if b.Subset != 0 {
+		res = append(res, blockOption{"subset", []interface{}{b.Subset}})
+	}
+	if b.KeyDropout != 0 {
+		res = append(res, blockOption{"keyDropout", []interface{}{b.KeyDropout}})
+	}
+	if b.Experts != 0 {
+		res = append(res, blockOption{"experts", []interface{}{
+			b.Experts,
+			b.TopK,
+			&anyvecsave.S{Vector: b.Router.Vector},
+		}})
+	}
+	if b.Ensemble != 0 {
+		res = append(res, blockOption{"ensemble", []interface{}{b.Ensemble}})
+	}
+	if b.EnsembleVariance {
+		res = append(res, blockOption{"ensembleVariance", nil})
+	}
+	if b.Ridge != nil {
+		res = append(res, blockOption{"ridge", []interface{}{
+			&anyvecsave.S{Vector: b.Ridge.Vector},
+		}})
+	}
+	if b.Rehearsal != 0 {
+		res = append(res, blockOption{"rehearsal", []interface{}{b.Rehearsal}})
+	}
+	if b.ReadMode != ReadAfterWrite {
+		res = append(res, blockOption{"readMode", []interface{}{int(b.ReadMode)}})
+	}
+	if b.LossOutputs {
+		res = append(res, blockOption{"lossOutputs", nil})
+	}
+	if b.Aggregation != ConcatQueries {
+		res = append(res, blockOption{"aggregation", []interface{}{int(b.Aggregation)}})
+	}
+	if b.QueryAttention != nil {
+		res = append(res, blockOption{"queryAttention", []interface{}{
+			&anyvecsave.S{Vector: b.QueryAttention.Vector},
+		}})
+	}
+	if len(b.ReadLayers) > 0 {
+		res = append(res, blockOption{"readLayers", []interface{}{encodeInts(b.ReadLayers)}})
+	}
+	if b.KeyDistance {
+		res = append(res, blockOption{"keyDistance", nil})
+	}
+	if b.LossPenalty != 0 {
+		res = append(res, blockOption{"lossPenalty", []interface{}{b.LossPenalty}})
+	}
+	if b.MaxSteps != 0 {
+		res = append(res, blockOption{"adaptive", []interface{}{
+			b.MaxSteps,
+			&anyvecsave.S{Vector: b.HaltThreshold.Vector},
+			b.HaltSharpness,
+			b.PonderCost,
+		}})
+	}
+	return res
+}
+
+// setOption decodes an option produced by options.
+func (b *Block) setOption(name string, data []byte) error {
+	switch name {
+	case "activation":
+		var act int
+		err := serializer.DeserializeAny(data, &act)
+		b.Activation = Activation(act)
+		return err
+	case "conv":
+		ints, err := decodeInts(data)
+		if err != nil {
+			return err
+		}
+		b.Conv, err = convLayersFromInts(ints)
+		return err
+	case "normKeys":
+		b.NormKeys = true
+		return nil
+	case "embedding":
+		b.Embedding = true
+		return serializer.DeserializeAny(data, &b.EmbeddingTopK)
+	case "initNet":
+		return serializer.DeserializeAny(data, &b.InitNet)
+	case "reset":
+		return serializer.DeserializeAny(data, &b.Reset)
+	case "writeGate":
+		return serializer.DeserializeAny(data, &b.WriteGate)
+	case "hardWrite":
+		b.HardWrite = true
+		return nil
+	case "eraseGate":
+		return serializer.DeserializeAny(data, &b.EraseGate)
+	case "stepSizeScale":
+		return serializer.DeserializeAny(data, &b.StepSizeScale)
+	case "gradClip":
+		return serializer.DeserializeAny(data, &b.GradClip)
+	case "elastic":
+		return serializer.DeserializeAny(data, &b.Elastic)
+	case "elasticGate":
+		return serializer.DeserializeAny(data, &b.ElasticGate)
+	case "decay":
+		return serializer.DeserializeAny(data, &b.Decay)
+	case "subset":
+		return serializer.DeserializeAny(data, &b.Subset)
+	case "keyDropout":
+		return serializer.DeserializeAny(data, &b.KeyDropout)
+	case "experts":
+		var router *anyvecsave.S
+		if err := serializer.DeserializeAny(data, &b.Experts, &b.TopK, &router); err != nil {
+			return err
+		}
+		b.Router = anydiff.NewVar(router.Vector)
+		return nil
+	case "ensemble":
+		return serializer.DeserializeAny(data, &b.Ensemble)
+	case "ensembleVariance":
+		b.EnsembleVariance = true
+		return nil
+	case "ridge":
+		var ridge *anyvecsave.S
+		if err := serializer.DeserializeAny(data, &ridge); err != nil {
+			return err
+		}
+		b.Ridge = anydiff.NewVar(ridge.Vector)
+		return nil
+	case "rehearsal":
+		return serializer.DeserializeAny(data, &b.Rehearsal)
+	case "readMode":
+		var mode int
+		err := serializer.DeserializeAny(data, &mode)
+		b.ReadMode = ReadMode(mode)
+		return err
+	case "lossOutputs":
+		b.LossOutputs = true
+		return nil
+	case "aggregation":
+		var agg int
+		err := serializer.DeserializeAny(data, &agg)
+		b.Aggregation = Aggregation(agg)
+		return err
+	case "queryAttention":
+		var attention *anyvecsave.S
+		if err := serializer.DeserializeAny(data, &attention); err != nil {
+			return err
+		}
+		b.QueryAttention = anydiff.NewVar(attention.Vector)
+		return nil
+	case "readLayers":
+		var err error
+		b.ReadLayers, err = decodeInts(data)
+		return err
+	case "keyDistance":
+		b.KeyDistance = true
+		return nil
+	case "lossPenalty":
+		return serializer.DeserializeAny(data, &b.LossPenalty)
+	case "adaptive":
+		var threshold *anyvecsave.S
+		err := serializer.DeserializeAny(data, &b.MaxSteps, &threshold, &b.HaltSharpness,
+			&b.PonderCost)
+		if err != nil {
+			return err
+		}
+		b.HaltThreshold = anydiff.NewVar(threshold.Vector)
+		return nil
+	default:
+		return errors.New("unknown option")
+	}
+}
+
+// applyGates applies all of the gates, producing a
+// vector suitable for gateValues.
+// If query is non-nil, it replaces the Query gate.
+func (b *Block) applyGates(x anydiff.Res, n int, query anydiff.Res) anydiff.MultiRes {
+	if query == nil {
+		query = b.Query.Apply(x, n)
+	}
+	outs := []anydiff.Res{b.TrainInput.Apply(x, n), b.TrainTarget.Apply(x, n),
+		b.StepSize.Apply(x, n), query}
+	var gates []anynet.Layer
+	if b.Reset != nil {
+		gates = append(gates, b.Reset)
+	}
+	if b.ElasticGate != nil {
+		gates = append(gates, b.ElasticGate)
+	}
+	if b.WriteGate != nil {
+		gates = append(gates, b.WriteGate)
+	}
+	if b.EraseGate != nil {
+		gates = append(gates, b.EraseGate)
+	}
 	for _, gate := range gates {
 		outs = append(outs, gate.Apply(x, n))
 	}
 	return anydiff.Fuse(outs...)
 }
 
+// gateValues stores the outputs of a Block's gates.
+type gateValues struct {
+	TrainIn     anydiff.Res
+	TrainTarget anydiff.Res
+	StepSize    anydiff.Res
+	Query       anydiff.Res
+
+	// Optional gates, which are nil if the corresponding
+	// gate is nil.
+	Reset   anydiff.Res
+	Elastic anydiff.Res
+	Write   anydiff.Res
+	Erase   anydiff.Res
+}
+
+// gateValues organizes the outputs from applyGates.
+func (b *Block) gateValues(outs []anydiff.Res) *gateValues {
+	res := &gateValues{
+		TrainIn:     outs[0],
+		TrainTarget: outs[1],
+		StepSize:    outs[2],
+		Query:       outs[3],
+	}
+	outs = outs[4:]
+	if b.Reset != nil {
+		res.Reset, outs = outs[0], outs[1:]
+	}
+	if b.ElasticGate != nil {
+		res.Elastic, outs = outs[0], outs[1:]
+	}
+	if b.WriteGate != nil {
+		res.Write, outs = outs[0], outs[1:]
+	}
+	if b.EraseGate != nil {
+		res.Erase = outs[0]
+	}
+	return res
+}
+
+// readWrite trains the networks and queries them in the
+// order given by b.ReadMode.
+// The result is [output, newParam1, newParam2, ...],
+// followed by the new rehearsal buffer and the unchanged
+// origin, followed by the inner losses if
+// b.computeLosses(), or the ponder costs for adaptive
+// computation.
+// The caller should pool the parameters, the buffer, and
+// the origin.
+func (b *Block) readWrite(params, buffer, origin []anydiff.Res, gates *gateValues,
+	info *stepInfo) anydiff.MultiRes {
+	n := info.N
+	net := &Net{
+		Parameters:    anydiff.Fuse(params...),
+		Num:           n,
+		Activation:    b.Activation,
+		GradClip:      b.GradClip,
+		LinearOutput:  b.Ridge != nil,
+		Conv:          b.Conv,
+		NormKeys:      b.NormKeys,
+		Embedding:     b.Embedding,
+		EmbeddingTopK: b.EmbeddingTopK,
+		Decay:         b.Decay,
+		Subset:        b.Subset,
+		KeyDropout:    b.KeyDropout,
+		Rand:          b.Rand,
+		check:         info.Check,
+	}
+	if b.Experts != 0 || b.Ensemble != 0 {
+		net.Num = n * (b.Experts + b.Ensemble)
+	}
+	b.setElastic(net, origin, gates.Elastic)
+	trainIn, trainTarget, stepSize, query := gates.TrainIn, gates.TrainTarget,
+		gates.StepSize, gates.Query
+	trainBatch := trainIn.Output().Len() / (net.InSize() * n)
+	queryBatch := query.Output().Len() / (net.InSize() * n)
+	if b.StepSizeScale != 0 {
+		scaler := stepSize.Output().Creator().MakeNumeric(b.StepSizeScale)
+		stepSize = anydiff.Scale(stepSize, scaler)
+	}
+	var writeGate anydiff.Res
+	var open []int
+	if gates.Write != nil {
+		writeGate, open = b.writeGate(gates.Write, n)
+		stepSize = anydiff.Mul(stepSize, writeGate)
+	}
+	if info.Check != nil {
+		info.Check.CheckVec(stepSize.Output(), "step size", -1, -1)
+	}
+
+	if gates.Erase != nil {
+		net.ExampleWeights = b.eraseWeights(gates.Erase, n, trainBatch)
+	}
+
+	// exampleMask, if non-nil, indicates which training
+	// examples are real, as opposed to empty buffer slots.
+	var exampleMask []float64
+
+	var newBuffer []anydiff.Res
+	if b.Rehearsal != 0 {
+		newBuffer = []anydiff.Res{
+			b.pushBuffer(buffer[0], trainIn, writeGate, n),
+			b.pushBuffer(buffer[1], trainTarget, writeGate, n),
+		}
+		counts := info.BufferCounts
+		info.BufferCounts = b.pushCounts(counts, writeGate, trainBatch)
+		var numBuffered int
+		for _, count := range counts {
+			if count > numBuffered {
+				numBuffered = count
+			}
+		}
+		if numBuffered > 0 {
+			inSize := trainIn.Output().Len() / (trainBatch * n)
+			outSize := trainTarget.Output().Len() / (trainBatch * n)
+			trainIn = batchedConcat(n, trainIn,
+				batchedSlice(buffer[0], n, 0, numBuffered*inSize))
+			trainTarget = batchedConcat(n, trainTarget,
+				batchedSlice(buffer[1], n, 0, numBuffered*outSize))
+			exampleMask = bufferMask(counts, trainBatch, numBuffered)
+			if exampleMask != nil {
+				c := trainIn.Output().Creator()
+				net.ExampleWeights = b.netWeights(maskWeights(c, exampleMask, n), n)
+				net.LossWeights = net.ExampleWeights
+			}
+			trainBatch += numBuffered
+		}
+	}
+
+	var before []anydiff.Res
+	if b.ReadMode != ReadAfterWrite {
+		before = append(before, b.read(net, query, n, queryBatch))
+	}
+
+	var trained anydiff.MultiRes
+	if b.MaxSteps != 0 {
+		trained, info.Steps = net.TrainAdaptive(trainIn, trainTarget, stepSize,
+			b.HaltThreshold, trainBatch, b.MaxSteps, b.haltSharpness())
+	} else if b.computeLosses() {
+		trained = net.TrainLosses(trainIn, trainTarget, stepSize, trainBatch, b.Steps)
+	} else if b.Experts != 0 {
+		trained = b.expertNet(net).Train(trainIn, trainTarget, stepSize, trainBatch,
+			b.Steps).Experts.Parameters
+	} else if b.Ensemble != 0 {
+		trained = net.Train(
+			batchedRepeat(trainIn, n, b.Ensemble),
+			batchedRepeat(trainTarget, n, b.Ensemble),
+			batchedRepeat(stepSize, n, b.Ensemble),
+			trainBatch,
+			b.Steps,
+		).Parameters
+	} else if open != nil {
+		trained = b.trainOpen(net, params, open, trainIn, trainTarget, stepSize,
+			trainBatch)
+	} else {
+		trained = net.Train(trainIn, trainTarget, stepSize, trainBatch, b.Steps).Parameters
+	}
+	return anydiff.PoolMulti(trained,
+		func(trained []anydiff.Res) anydiff.MultiRes {
+			extras := trained[len(params):]
+			read := func(newParams []anydiff.Res) anydiff.MultiRes {
+				outputs := before
+				if b.ReadMode != ReadBeforeWrite {
+					net1 := net.withParameters(anydiff.Fuse(newParams...))
+					outputs = append(outputs, b.read(net1, query, n, queryBatch))
+				}
+				if b.LossOutputs {
+					outputs = append(outputs, extras[0])
+				}
+				if b.KeyDistance {
+					outputs = append(outputs, b.keyDistances(query, trainIn, exampleMask, n,
+						queryBatch, trainBatch))
+				}
+				res := append([]anydiff.Res{batchedConcat(n, outputs...)}, newParams...)
+				res = append(res, newBuffer...)
+				res = append(res, origin...)
+				return anydiff.Fuse(append(res, extras...)...)
+			}
+			if b.Ridge == nil {
+				return read(trained[:len(params)])
+			}
+			solved := b.solveRidge(net, trained[:len(params)], trainIn, trainTarget,
+				exampleMask, trainBatch, info)
+			return anydiff.PoolMulti(solved, read)
+		})
+}
+
+// read applies the storage networks to the queries and
+// aggregates the results according to b.Aggregation.
+func (b *Block) read(net *Net, query anydiff.Res, n, queryBatch int) anydiff.Res {
+	out := b.applyNet(net, query, queryBatch)
+	if b.Aggregation == ConcatQueries {
+		return out
+	}
+	return anydiff.Pool(out, func(out anydiff.Res) anydiff.Res {
+		c := out.Output().Creator()
+		rowSize := out.Output().Len() / (n * queryBatch)
+		rows := &anydiff.Matrix{Data: out, Rows: n * queryBatch, Cols: rowSize}
+		perSeq := &anydiff.MatrixBatch{Data: out, Rows: queryBatch, Cols: rowSize, Num: n}
+		switch b.Aggregation {
+		case MeanQueries:
+			scaler := c.MakeNumeric(1 / float64(queryBatch))
+			return anydiff.Scale(batchedSumRows(perSeq), scaler)
+		case MaxQueries:
+			// Select the maxima with a constant mask, so that
+			// gradients flow through the largest outputs.
+			values := vecFloats(out.Output())
+			mask := make([]float64, len(values))
+			for seq := 0; seq < n; seq++ {
+				start := seq * queryBatch * rowSize
+				for col := 0; col < rowSize; col++ {
+					best := start + col
+					for row := 1; row < queryBatch; row++ {
+						if idx := start + row*rowSize + col; values[idx] > values[best] {
+							best = idx
+						}
+					}
+					mask[best] = 1
+				}
+			}
+			maskVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(mask)))
+			perSeq.Data = anydiff.Mul(out, maskVec)
+			return batchedSumRows(perSeq)
+		case AttentionQueries:
+			if b.QueryAttention.Vector.Len() != rowSize {
+				panic(fmt.Sprintf("attention vector size %d should be %d",
+					b.QueryAttention.Vector.Len(), rowSize))
+			}
+			attention := &anydiff.Matrix{Data: b.QueryAttention, Rows: 1, Cols: rowSize}
+			scores := anydiff.MatMul(false, true, rows, attention).Data
+			weights := anydiff.Exp(anydiff.LogSoftmax(scores, queryBatch))
+			perSeq.Data = anydiff.ScaleRows(rows, weights).Data
+			return batchedSumRows(perSeq)
+		default:
+			panic(fmt.Sprintf("unknown aggregation: %d", b.Aggregation))
+		}
+	})
+}
+
+// applyNet applies the storage networks, which are
+// mixtures of experts if b.Experts is non-zero or
+// ensembles if b.Ensemble is non-zero.
+func (b *Block) applyNet(net *Net, inBatch anydiff.Res, batchSize int) anydiff.Res {
+	if b.Experts != 0 {
+		return b.expertNet(net).Apply(inBatch, batchSize)
+	} else if b.Ensemble != 0 {
+		return b.applyEnsemble(net, inBatch, batchSize)
+	} else if len(b.ReadLayers) > 0 {
+		return b.applyReadLayers(net, inBatch, batchSize)
+	}
+	return net.Apply(inBatch, batchSize)
+}
+
+// applyReadLayers applies the storage networks and
+// concatenates the output for each query with the
+// activations of the layers in b.ReadLayers.
+func (b *Block) applyReadLayers(net *Net, inBatch anydiff.Res, batchSize int) anydiff.Res {
+	return anydiff.Unfuse(net.ApplyAll(inBatch, batchSize),
+		func(outs []anydiff.Res) anydiff.Res {
+			res := []anydiff.Res{outs[len(outs)-1]}
+			for _, layer := range b.ReadLayers {
+				if layer < 0 || layer >= len(outs) {
+					panic(fmt.Sprintf("read layer %d out of bounds", layer))
+				}
+				res = append(res, outs[layer])
+			}
+			return batchedConcat(net.Num*batchSize, res...)
+		})
+}
+
+// applyEnsemble averages the outputs of the ensemble
+// members for each query, followed by the variance if
+// b.EnsembleVariance is set.
+func (b *Block) applyEnsemble(net *Net, inBatch anydiff.Res, batchSize int) anydiff.Res {
+	n := net.Num / b.Ensemble
+	c := inBatch.Output().Creator()
+	scaler := c.MakeNumeric(1 / float64(b.Ensemble))
+	outs := net.Apply(batchedRepeat(inBatch, n, b.Ensemble), batchSize)
+	return anydiff.Pool(outs, func(outs anydiff.Res) anydiff.Res {
+		memberMean := func(vec anydiff.Res) anydiff.Res {
+			return anydiff.Scale(batchedSumRows(&anydiff.MatrixBatch{
+				Data: vec,
+				Rows: b.Ensemble,
+				Cols: vec.Output().Len() / net.Num,
+				Num:  n,
+			}), scaler)
+		}
+		mean := memberMean(outs)
+		if !b.EnsembleVariance {
+			return mean
+		}
+		return anydiff.Pool(mean, func(mean anydiff.Res) anydiff.Res {
+			variance := anydiff.Sub(memberMean(anydiff.Square(outs)), anydiff.Square(mean))
+			outSize := mean.Output().Len() / (n * batchSize)
+			queryVariance := anydiff.SumCols(&anydiff.Matrix{
+				Data: variance,
+				Rows: n * batchSize,
+				Cols: outSize,
+			})
+			queryVariance = anydiff.Scale(queryVariance, c.MakeNumeric(1/float64(outSize)))
+			return batchedConcat(n*batchSize, mean, queryVariance)
+		})
+	})
+}
+
+// expertNet wraps a batch of storage networks containing
+// b.Experts networks per sequence.
+func (b *Block) expertNet(net *Net) *ExpertNet {
+	return &ExpertNet{
+		Experts:    net,
+		Num:        net.Num / b.Experts,
+		NumExperts: b.Experts,
+		Router:     b.Router,
+		TopK:       b.TopK,
+	}
+}
+
+// solveRidge replaces the final layer of the storage
+// networks with the solution to a ridge regression
+// problem on the training batch.
+//
+// The regression is solved in its dual form, since there
+// are typically fewer examples than hidden units.
+// The parameters should be pooled by the caller.
+//
+// If a system cannot be solved, the problem is reported
+// in info.SolveErr.
+func (b *Block) solveRidge(net *Net, params []anydiff.Res, inBatch, target anydiff.Res,
+	mask []float64, batchSize int, info *stepInfo) anydiff.MultiRes {
+	n := net.Num
+	c := target.Output().Creator()
+	if net.convLayer(len(params)/2-1) != nil {
+		panic("ridge regression requires a fully-connected final layer")
+	}
+	hidden := params[:len(params)-2]
+	var features anydiff.Res
+	if len(hidden) > 0 {
+		hiddenNet := net.withParameters(anydiff.Fuse(hidden...))
+		hiddenNet.LinearOutput = false
+		features = hiddenNet.Apply(inBatch, batchSize)
+	} else {
+		features = net.prepareKeys(inBatch, batchSize)
+	}
+	var biasKernel anydiff.Res
+	if mask != nil {
+		// Masked examples have no features (including the
+		// bias feature) and zero targets, so their dual
+		// variables are zero.
+		maskVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(mask)))
+		features = maskRows(features, maskVec, n*batchSize)
+		target = maskRows(target, maskVec, n*batchSize)
+		outer := make([]float64, 0, n*batchSize*batchSize)
+		for i := 0; i < n; i++ {
+			seqMask := mask[i*batchSize : (i+1)*batchSize]
+			for _, x := range seqMask {
+				for _, y := range seqMask {
+					outer = append(outer, x*y)
+				}
+			}
+		}
+		biasKernel = anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(outer)))
+	}
+	return anydiff.PoolFork(features, func(features anydiff.Res) anydiff.MultiRes {
+		featureMat := &anydiff.MatrixBatch{
+			Data: features,
+			Rows: batchSize,
+			Cols: features.Output().Len() / (batchSize * n),
+			Num:  n,
+		}
+		kernel := anydiff.BatchedMatMul(false, true, featureMat, featureMat).Data
+
+		// Adding 1 to every entry is equivalent to adding a
+		// constant bias feature.
+		if biasKernel != nil {
+			kernel = anydiff.Add(kernel, biasKernel)
+		} else {
+			kernel = anydiff.AddScalar(kernel, c.MakeNumeric(1))
+		}
+
+		identity := make([]float64, n*batchSize*batchSize)
+		for i := 0; i < n; i++ {
+			for j := 0; j < batchSize; j++ {
+				identity[(i*batchSize+j)*batchSize+j] = 1
+			}
+		}
+		strength := anydiff.Exp(b.Ridge)
+		if vecFloats(strength.Output())[0] < MinRidge {
+			strength = anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(
+				[]float64{MinRidge})))
+		}
+		reg := anydiff.ScaleRows(&anydiff.Matrix{
+			Data: anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(identity))),
+			Rows: 1,
+			Cols: len(identity),
+		}, strength).Data
+
+		dual, err := batchedSolve(
+			&anydiff.MatrixBatch{
+				Data: anydiff.Add(kernel, reg),
+				Rows: batchSize,
+				Cols: batchSize,
+				Num:  n,
+			},
+			&anydiff.MatrixBatch{
+				Data: target,
+				Rows: batchSize,
+				Cols: target.Output().Len() / (batchSize * n),
+				Num:  n,
+			},
+		)
+		if err != nil && info.SolveErr == nil {
+			info.SolveErr = &NonFiniteError{
+				Sequence:  info.Sequences[err.(*singularError).Index],
+				Timestep:  info.Timestep,
+				InnerStep: -1,
+				Layer:     len(params)/2 - 1,
+				Value:     "ridge solution",
+			}
+		}
+		return anydiff.PoolFork(dual.Data, func(dualData anydiff.Res) anydiff.MultiRes {
+			dualMat := *dual
+			dualMat.Data = dualData
+			weights := anydiff.BatchedMatMul(true, false, &dualMat, featureMat).Data
+			biases := batchedSumRows(&dualMat)
+			return anydiff.Fuse(append(hidden[:len(hidden):len(hidden)], weights, biases)...)
+		})
+	})
+}
+
+// setElastic sets up elastic regularization for the
+// storage network, if it is enabled.
+// The anchors are the start parameters (see startParams).
+func (b *Block) setElastic(net *Net, origin []anydiff.Res, gateOut anydiff.Res) {
+	if gateOut != nil {
+		if gateOut.Output().Len() != net.Num {
+			panic("elastic gate must produce one value per sequence")
+		}
+		net.Elastic = gateOut
+	} else if b.Elastic != 0 {
+		c := b.InitParams[0].Vector.Creator()
+		coeffs := c.MakeVector(net.Num)
+		coeffs.AddScalar(c.MakeNumeric(b.Elastic))
+		net.Elastic = anydiff.NewConst(coeffs)
+	} else {
+		return
+	}
+	net.Anchor = b.startParams(origin, net.Num)
+}
+
+// keyDistances computes the squared distance from every
+// query to the nearest training input of the same
+// sequence.
+//
+// If mask is non-nil, keys with a mask value of 0 are
+// ignored.
+func (b *Block) keyDistances(query, keys anydiff.Res, mask []float64, n, queryBatch,
+	trainBatch int) anydiff.Res {
+	keySize := query.Output().Len() / (n * queryBatch)
+	if b.NormKeys {
+		query = normalizeRows(&anydiff.Matrix{
+			Data: query,
+			Rows: n * queryBatch,
+			Cols: keySize,
+		})
+		keys = normalizeRows(&anydiff.Matrix{Data: keys, Rows: n * trainBatch, Cols: keySize})
+	}
+
+	// Compare every query to every key of its network.
+	pairs := anydiff.Sub(
+		batchedRepeat(query, n*queryBatch, trainBatch),
+		batchedRepeat(keys, n, queryBatch),
+	)
+	dists := anydiff.SumCols(&anydiff.Matrix{
+		Data: anydiff.Square(pairs),
+		Rows: n * queryBatch * trainBatch,
+		Cols: keySize,
+	})
+
+	// Select the minimum with a constant one-hot mask, so
+	// that gradients flow through the nearest key.
+	values := vecFloats(dists.Output())
+	oneHot := make([]float64, len(values))
+	for i := 0; i < len(values); i += trainBatch {
+		// The first example of every sequence is never
+		// masked, since it was written at this timestep.
+		best := i
+		seqStart := (i / (queryBatch * trainBatch)) * trainBatch
+		for j := i + 1; j < i+trainBatch; j++ {
+			if mask != nil && mask[seqStart+j-i] == 0 {
+				continue
+			}
+			if values[j] < values[best] {
+				best = j
+			}
+		}
+		oneHot[best] = 1
+	}
+	c := dists.Output().Creator()
+	maskVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(oneHot)))
+	return anydiff.SumCols(&anydiff.Matrix{
+		Data: anydiff.Mul(dists, maskVec),
+		Rows: n * queryBatch,
+		Cols: trainBatch,
+	})
+}
+
+// pushCounts computes the new number of examples in each
+// sequence's rehearsal buffer after a write of numNew
+// examples.
+// Sequences whose write gates are closed keep their old
+// counts.
+func (b *Block) pushCounts(counts []int, writeGate anydiff.Res, numNew int) []int {
+	var gates []float64
+	if writeGate != nil {
+		gates = vecFloats(writeGate.Output())
+	}
+	res := make([]int, len(counts))
+	for i, count := range counts {
+		if gates == nil || gates[i] > 0.5 {
+			count += numNew
+			if count > b.Rehearsal {
+				count = b.Rehearsal
+			}
+		}
+		res[i] = count
+	}
+	return res
+}
+
+// bufferMask creates a mask over each sequence's training
+// batch of numNew examples followed by numBuffered
+// rehearsed examples, where empty buffer slots have a
+// value of 0.
+// It returns nil if no slots are empty.
+func bufferMask(counts []int, numNew, numBuffered int) []float64 {
+	var res []float64
+	var empty bool
+	for _, count := range counts {
+		for i := 0; i < numNew+numBuffered; i++ {
+			if i < numNew+count {
+				res = append(res, 1)
+			} else {
+				res = append(res, 0)
+				empty = true
+			}
+		}
+	}
+	if !empty {
+		return nil
+	}
+	return res
+}
+
+// maskWeights converts a mask over the examples of n
+// training batches into example weights.
+// Masked examples have weight 0, and the others are
+// scaled up so that the mean loss is unaffected (as in
+// Net.subsetWeights).
+func maskWeights(c anyvec.Creator, mask []float64, n int) anydiff.Res {
+	batchSize := len(mask) / n
+	weights := make([]float64, len(mask))
+	for i := 0; i < n; i++ {
+		seqMask := mask[i*batchSize : (i+1)*batchSize]
+		var numReal float64
+		for _, x := range seqMask {
+			numReal += x
+		}
+		for j, x := range seqMask {
+			weights[i*batchSize+j] = x * float64(batchSize) / numReal
+		}
+	}
+	return anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(weights)))
+}
+
+// maskRows multiplies each of the rows of a matrix by the
+// corresponding mask value.
+func maskRows(data, mask anydiff.Res, rows int) anydiff.Res {
+	return anydiff.ScaleRows(&anydiff.Matrix{
+		Data: data,
+		Rows: rows,
+		Cols: data.Output().Len() / rows,
+	}, mask).Data
+}
+
+// pushBuffer adds the latest examples to the front of a
+// rehearsal buffer, discarding the oldest examples.
+//
+// If writeGate is non-nil, each sequence's buffer is
+// interpolated towards the new buffer by the
+// corresponding amount, so that a sequence which does not
+// write keeps its old buffer.
+func (b *Block) pushBuffer(buffer, examples, writeGate anydiff.Res, n int) anydiff.Res {
+	pushed := batchedSlice(batchedConcat(n, examples, buffer), n, 0, buffer.Output().Len()/n)
+	if writeGate == nil {
+		return pushed
+	}
+	diff := &anydiff.Matrix{
+		Data: anydiff.Sub(pushed, buffer),
+		Rows: n,
+		Cols: buffer.Output().Len() / n,
+	}
+	return anydiff.Add(buffer, anydiff.ScaleRows(diff, writeGate).Data)
+}
+
+// computeLosses checks if Step must compute the inner
+// losses.
+func (b *Block) computeLosses() bool {
+	return b.LossOutputs || b.LossPenalty != 0
+}
+
+// penalties returns the constant upstream vectors for the
+// extra outputs of readWrite, which follow the parameters.
+func (b *Block) penalties() []float64 {
+	if b.MaxSteps != 0 {
+		return []float64{b.PonderCost}
+	} else if b.computeLosses() {
+		return []float64{b.LossPenalty}
+	}
+	return nil
+}
+
+func (b *Block) haltSharpness() float64 {
+	if b.HaltSharpness == 0 {
+		return DefaultHaltSharpness
+	}
+	return b.HaltSharpness
+}
+
+// writeGate computes the amount by which each sequence
+// writes from the outputs of the write gate.
+//
+// If b.HardWrite is set, the outputs are rounded, and the
+// indices of the sequences whose gates are open are
+// returned as well.
+// Otherwise, the outputs are used as-is and the returned
+// indices are nil.
+func (b *Block) writeGate(gateOut anydiff.Res, n int) (anydiff.Res, []int) {
+	if gateOut.Output().Len() != n {
+		panic("write gate must produce one value per sequence")
+	}
+	if !b.HardWrite {
+		return gateOut, nil
+	}
+	open := []int{}
+	offsets := make([]float64, n)
+	for i, x := range vecFloats(gateOut.Output()) {
+		if x > 0.5 {
+			open = append(open, i)
+			offsets[i] = 1 - x
+		} else {
+			offsets[i] = -x
+		}
+	}
+	// Adding a constant rounds the gate without changing
+	// its gradient.
+	c := gateOut.Output().Creator()
+	offsetVec := c.MakeVectorData(c.MakeNumericList(offsets))
+	return anydiff.Add(gateOut, anydiff.NewConst(offsetVec)), open
+}
+
+// eraseWeights computes example weights from the outputs
+// of the erase gate.
+func (b *Block) eraseWeights(gateOut anydiff.Res, n, trainBatch int) anydiff.Res {
+	if gateOut.Output().Len() != n*trainBatch {
+		panic("erase gate must produce one value per training example")
+	}
+	c := gateOut.Output().Creator()
+	weights := anydiff.AddScalar(anydiff.Scale(gateOut, c.MakeNumeric(-2)), c.MakeNumeric(1))
+	return b.netWeights(weights, n)
+}
+
+// netWeights repeats the example weights of each sequence
+// for every expert or ensemble member, producing weights
+// for the storage networks.
+func (b *Block) netWeights(weights anydiff.Res, n int) anydiff.Res {
+	if b.Experts+b.Ensemble == 0 {
+		return weights
+	}
+	return batchedRepeat(weights, n, b.Experts+b.Ensemble)
+}
+
+// trainOpen trains the networks of the sequences whose
+// write gates are open, leaving the other networks
+// unchanged.
+// The params are the parameters of net, which should be
+// pooled by the caller.
+func (b *Block) trainOpen(net *Net, params []anydiff.Res, open []int, trainIn, trainTarget,
+	stepSize anydiff.Res, trainBatch int) anydiff.MultiRes {
+	if len(open) == net.Num {
+		return net.Train(trainIn, trainTarget, stepSize, trainBatch, b.Steps).Parameters
+	} else if len(open) == 0 {
+		return net.Parameters
+	}
+	sub := net.selectNets(open)
+	trained := sub.Train(
+		selectChunks(trainIn, net.Num, open),
+		selectChunks(trainTarget, net.Num, open),
+		selectChunks(stepSize, net.Num, open),
+		trainBatch,
+		b.Steps,
+	).Parameters
+	if net.check != nil {
+		net.check.Step = sub.check.Step
+		if net.check.Err == nil {
+			net.check.Err = sub.check.Err
+		}
+	}
+	return anydiff.PoolMulti(trained, func(trained []anydiff.Res) anydiff.MultiRes {
+		var res []anydiff.Res
+		for i, p := range params {
+			chunks := splitVec(p, net.Num)
+			for j, seq := range open {
+				chunks[seq] = anydiff.Slice(trained[i], j*p.Output().Len()/net.Num,
+					(j+1)*p.Output().Len()/net.Num)
+			}
+			res = append(res, anydiff.Concat(chunks...))
+		}
+		return anydiff.Fuse(res...)
+	})
+}
+
+// reset interpolates every network's parameters towards
+// the start parameters (see startParams) by the
+// corresponding amount.
+func (b *Block) reset(params, origin []anydiff.Res, amounts anydiff.Res,
+	n int) []anydiff.Res {
+	if amounts.Output().Len() != n {
+		panic("reset gate must produce one value per sequence")
+	}
+	start := b.startParams(origin, n)
+	res := make([]anydiff.Res, len(params))
+	for i, p := range params {
+		diff := &anydiff.Matrix{
+			Data: anydiff.Sub(start[i], p),
+			Rows: n,
+			Cols: p.Output().Len() / n,
+		}
+		res[i] = anydiff.Add(p, anydiff.ScaleRows(diff, amounts).Data)
+	}
+	return res
+}
+
+// startParams returns the parameters of the start
+// state: the origin if the start state was generated by
+// InitNet, or else InitParams repeated for each network.
+func (b *Block) startParams(origin []anydiff.Res, n int) []anydiff.Res {
+	if len(origin) > 0 {
+		return origin
+	}
+	var res []anydiff.Res
+	for _, p := range b.InitParams {
+		res = append(res, repeatVec(p, n))
+	}
+	return res
+}
+
+// resetBuffer clears the rehearsal buffer of every
+// sequence by the corresponding amount, so that a reset
+// does not rehearse examples from before the reset.
+// Sequences with amounts above 0.5 are treated as having
+// empty buffers, and the new counts reflect this.
+func (b *Block) resetBuffer(buffer []anydiff.Res, counts []int, amounts anydiff.Res,
+	n int) ([]anydiff.Res, []int) {
+	if len(buffer) == 0 {
+		return buffer, counts
+	}
+	c := amounts.Output().Creator()
+	keep := anydiff.AddScalar(anydiff.Scale(amounts, c.MakeNumeric(-1)), c.MakeNumeric(1))
+	newCounts := make([]int, n)
+	for i, amount := range vecFloats(amounts.Output()) {
+		if amount <= 0.5 {
+			newCounts[i] = counts[i]
+		}
+	}
+	return []anydiff.Res{
+		maskRows(buffer[0], keep, n),
+		maskRows(buffer[1], keep, n),
+	}, newCounts
+}
+
+// stepInfo stores information about the timestep being
+// evaluated by Block.Step.
+type stepInfo struct {
+	// N is the number of present sequences.
+	N int
+
+	// Timestep is the index of the timestep.
+	Timestep int
+
+	// Sequences maps network indices to sequence indices.
+	Sequences []int
+
+	// Check, if non-nil, is used to find non-finite values.
+	Check *finiteChecker
+
+	// SolveErr is set if the closed-form write fails.
+	SolveErr *NonFiniteError
+
+	// Steps is set to the number of SGD steps taken for
+	// each network when using adaptive computation.
+	Steps []int
+
+	// BufferCounts is the number of examples in each
+	// sequence's rehearsal buffer.
+	// It is updated as the buffer changes.
+	BufferCounts []int
+}
+
 // State is the anyrnn.State and anyrnn.StateGrad type for
 // a Block.
 type State struct {
 	Params []*anyrnn.VecState
+
+	// Buffer stores the inputs and targets in the
+	// rehearsal buffer, most recent first.
+	// It is empty if the Block has no rehearsal buffer.
+	Buffer []*anyrnn.VecState
+
+	// BufferCounts stores the number of examples in each
+	// present sequence's rehearsal buffer.
+	// It is nil if the Block has no rehearsal buffer.
+	BufferCounts []int
+
+	// Origin stores the start parameters generated by
+	// InitNet, which the Reset gate and elastic
+	// regularization restore towards.
+	// It is empty if the start state came from InitParams.
+	Origin []*anyrnn.VecState
+
+	// Timestep is the number of timesteps which led up to
+	// the state.
+	Timestep int
+
+	// Steps stores the number of SGD steps taken for each
+	// present sequence at the timestep which produced the
+	// state, if the Block uses adaptive computation.
+	// Otherwise, it is nil.
+	Steps []int
+
+	// FiniteErr is the first non-finite value found at the
+	// timestep which produced the state, if the Block has
+	// CheckFinite enabled.
+	// Failures of the closed-form write (see Block.Ridge)
+	// are reported even without CheckFinite.
+	// Otherwise, it is nil.
+	FiniteErr *NonFiniteError
+
+	// start is the result which produced the start state,
+	// if it was generated by InitNet.
+	// It is used by PropagateStart.
+	start anydiff.MultiRes
 }
 
 // Present returns the present sequence map.
@@ -244,37 +2244,92 @@ func (s *State) Present() anyrnn.PresentMap {
 
 // Reduce removes states.
 func (s *State) Reduce(p anyrnn.PresentMap) anyrnn.State {
-	res := &State{Params: make([]*anyrnn.VecState, len(s.Params))}
-	for i, param := range s.Params {
-		res.Params[i] = param.Reduce(p).(*anyrnn.VecState)
+	vecs := s.vecs()
+	for i, vec := range vecs {
+		vecs[i] = vec.Reduce(p).(*anyrnn.VecState)
+	}
+	res := s.withVecs(vecs)
+	res.Steps = reduceInts(s.Steps, s.Present(), p)
+	res.BufferCounts = reduceInts(s.BufferCounts, s.Present(), p)
+	return res
+}
+
+// reduceInts removes the entries of a per-sequence list
+// for sequences which are not present in p.
+// The list has one entry for each present sequence in
+// old.
+func reduceInts(list []int, old, p anyrnn.PresentMap) []int {
+	if list == nil {
+		return nil
+	}
+	var res []int
+	var idx int
+	for i, pres := range old {
+		if pres {
+			if p[i] {
+				res = append(res, list[idx])
+			}
+			idx++
+		}
 	}
 	return res
 }
 
 // Expand inserts gradients.
 func (s *State) Expand(p anyrnn.PresentMap) anyrnn.StateGrad {
-	res := &State{Params: make([]*anyrnn.VecState, len(s.Params))}
-	for i, param := range s.Params {
-		res.Params[i] = param.Expand(p).(*anyrnn.VecState)
+	vecs := s.vecs()
+	for i, vec := range vecs {
+		vecs[i] = vec.Expand(p).(*anyrnn.VecState)
+	}
+	return s.withVecs(vecs)
+}
+
+// vecs returns the parameters, followed by the buffer,
+// followed by the origin.
+func (s *State) vecs() []*anyrnn.VecState {
+	res := append([]*anyrnn.VecState{}, s.Params...)
+	return append(append(res, s.Buffer...), s.Origin...)
+}
+
+// withVecs creates a State like s, but with the vectors
+// from vecs replaced.
+func (s *State) withVecs(vecs []*anyrnn.VecState) *State {
+	numParams, numBuffer := len(s.Params), len(s.Buffer)
+	return &State{
+		Params:       vecs[:numParams],
+		Buffer:       vecs[numParams : numParams+numBuffer],
+		Origin:       vecs[numParams+numBuffer:],
+		Timestep:     s.Timestep,
+		Steps:        s.Steps,
+		BufferCounts: s.BufferCounts,
+		FiniteErr:    s.FiniteErr,
+		start:        s.start,
 	}
-	return res
 }
 
 func (s *State) pool() []*anydiff.Var {
-	res := make([]*anydiff.Var, len(s.Params))
-	for i, packed := range s.Params {
+	vecs := s.vecs()
+	res := make([]*anydiff.Var, len(vecs))
+	for i, packed := range vecs {
 		res[i] = anydiff.NewVar(packed.Vector)
 	}
 	return res
 }
 
 type blockRes struct {
-	InPool   *anydiff.Var
-	NetPools []*anydiff.Var
+	InPool *anydiff.Var
+	// StatePools stores the parameters, the rehearsal
+	// buffer, and the origin.
+	StatePools []*anydiff.Var
+
 	OutVec   anyvec.Vector
 	OutState *State
 	AllRes   anydiff.MultiRes
 	V        anydiff.VarSet
+
+	// Penalties are the constant upstream values for the
+	// last outputs of AllRes.
+	Penalties []float64
 }
 
 func (b *blockRes) State() anyrnn.State {
@@ -293,19 +2348,24 @@ func (b *blockRes) Propagate(u anyvec.Vector, s anyrnn.StateGrad,
 	g anydiff.Grad) (anyvec.Vector, anyrnn.StateGrad) {
 	allUpstream := make([]anyvec.Vector, len(b.AllRes.Outputs()))
 	allUpstream[0] = u
-	if s == nil {
-		for i, x := range allUpstream {
-			if x == nil {
-				size := b.AllRes.Outputs()[i].Len()
-				allUpstream[i] = u.Creator().MakeVector(size)
-			}
-		}
-	} else {
+	if s != nil {
 		sg := s.(*State)
-		for i, vecs := range sg.Params {
+		for i, vecs := range sg.vecs() {
 			allUpstream[i+1] = vecs.Vector
 		}
 	}
+	for i, value := range b.Penalties {
+		idx := len(allUpstream) - len(b.Penalties) + i
+		penalty := u.Creator().MakeVector(b.AllRes.Outputs()[idx].Len())
+		penalty.AddScalar(u.Creator().MakeNumeric(value))
+		allUpstream[idx] = penalty
+	}
+	for i, x := range allUpstream {
+		if x == nil {
+			size := b.AllRes.Outputs()[i].Len()
+			allUpstream[i] = u.Creator().MakeVector(size)
+		}
+	}
 
 	for _, p := range b.pools() {
 		g[p] = p.Vector.Creator().MakeVector(p.Vector.Len())
@@ -316,17 +2376,17 @@ func (b *blockRes) Propagate(u anyvec.Vector, s anyrnn.StateGrad,
 
 	b.AllRes.Propagate(allUpstream, g)
 
-	paramGrad := make([]*anyrnn.VecState, len(b.NetPools))
-	for i, netPool := range b.NetPools {
-		paramGrad[i] = &anyrnn.VecState{
-			Vector:     g[netPool],
+	stateGrad := make([]*anyrnn.VecState, len(b.StatePools))
+	for i, pool := range b.StatePools {
+		stateGrad[i] = &anyrnn.VecState{
+			Vector:     g[pool],
 			PresentMap: b.OutState.Present(),
 		}
 	}
 
-	return g[b.InPool], &State{Params: paramGrad}
+	return g[b.InPool], b.OutState.withVecs(stateGrad)
 }
 
 func (b *blockRes) pools() []*anydiff.Var {
-	return append([]*anydiff.Var{b.InPool}, b.NetPools...)
+	return append([]*anydiff.Var{b.InPool}, b.StatePools...)
 }
@@ -0,0 +1,141 @@
+package sgdstore
+
+import (
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer((&ContextBlock{}).SerializerType(),
+		DeserializeContextBlock)
+}
+
+// ContextBlock wraps a Block with an InitNet, using the
+// first input of every sequence as the context for
+// StartContext.
+//
+// At the first timestep, the Block is started from the
+// inputs and then evaluated on the same inputs, so the
+// InitNet's input size must match the Block's.
+// Gradients flow into the first inputs through both the
+// InitNet and the Block's gates.
+// After the first timestep, the states are the Block's
+// own States.
+type ContextBlock struct {
+	Block *Block
+}
+
+// DeserializeContextBlock deserializes a ContextBlock.
+func DeserializeContextBlock(d []byte) (block *ContextBlock, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.ContextBlock", &err)
+	block = &ContextBlock{}
+	if err := serializer.DeserializeAny(d, &block.Block); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Start produces a placeholder start state, since the
+// initial parameters depend on the first inputs.
+func (c *ContextBlock) Start(n int) anyrnn.State {
+	present := make(contextStart, n)
+	for i := range present {
+		present[i] = true
+	}
+	return present
+}
+
+// PropagateStart does nothing, since gradients through
+// the initial parameters are propagated by the first
+// timestep.
+func (c *ContextBlock) PropagateStart(s anyrnn.StateGrad, g anydiff.Grad) {
+}
+
+// Step evaluates the block.
+func (c *ContextBlock) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
+	start, ok := s.(contextStart)
+	if !ok {
+		return c.Block.Step(s, in)
+	}
+	present := anyrnn.PresentMap(start)
+	inPool := anydiff.NewVar(in)
+	state := c.Block.StartContext(inPool, present.NumPresent()).(*State)
+
+	// StartContext assumes that every sequence is present.
+	for _, vec := range state.vecs() {
+		vec.PresentMap = present
+	}
+
+	return &contextRes{
+		Block:   c.Block,
+		InPool:  inPool,
+		Present: present,
+		Res:     c.Block.Step(state, in),
+	}
+}
+
+// Parameters returns the parameters of the Block.
+func (c *ContextBlock) Parameters() []*anydiff.Var {
+	return c.Block.Parameters()
+}
+
+// SerializerType returns the unique ID used to serialize
+// a ContextBlock with the serializer package.
+func (c *ContextBlock) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.ContextBlock"
+}
+
+// Serialize serializes the block.
+func (c *ContextBlock) Serialize() ([]byte, error) {
+	return serializer.SerializeAny(c.Block)
+}
+
+// contextStart is the start state and start state
+// gradient of a ContextBlock.
+type contextStart anyrnn.PresentMap
+
+func (c contextStart) Present() anyrnn.PresentMap {
+	return anyrnn.PresentMap(c)
+}
+
+func (c contextStart) Reduce(p anyrnn.PresentMap) anyrnn.State {
+	return contextStart(p)
+}
+
+func (c contextStart) Expand(p anyrnn.PresentMap) anyrnn.StateGrad {
+	return contextStart(p)
+}
+
+type contextRes struct {
+	Block   *Block
+	InPool  *anydiff.Var
+	Present anyrnn.PresentMap
+	Res     anyrnn.Res
+}
+
+func (c *contextRes) State() anyrnn.State {
+	return c.Res.State()
+}
+
+func (c *contextRes) Output() anyvec.Vector {
+	return c.Res.Output()
+}
+
+func (c *contextRes) Vars() anydiff.VarSet {
+	return c.Res.Vars()
+}
+
+func (c *contextRes) Propagate(u anyvec.Vector, s anyrnn.StateGrad,
+	g anydiff.Grad) (anyvec.Vector, anyrnn.StateGrad) {
+	inGrad, startGrad := c.Res.Propagate(u, s, g)
+
+	// The context gradient accumulates into inGrad.
+	g[c.InPool] = inGrad
+	defer delete(g, c.InPool)
+	c.Block.PropagateStart(startGrad, g)
+
+	return inGrad, contextStart(c.Present)
+}
@@ -0,0 +1,68 @@
+package sgdstore
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anydifftest"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/serializer"
+)
+
+func TestContextBlock(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := testBlock()
+	block.InitNet = anynet.NewFC(c, 3, 4*2+2)
+	randomizeParams(block)
+	model := &ContextBlock{Block: block}
+
+	in1 := c.MakeVectorData([]float64{0.3, 0.5, -0.3, 0.1, -0.2, 0.7})
+	in2 := c.MakeVectorData([]float64{-0.4, 0.2, 0.6, 0.5, 0.1, -0.3})
+
+	t.Run("Value", func(t *testing.T) {
+		out1 := model.Step(model.Start(2), in1)
+		actual := model.Step(out1.State(), in2).Output()
+
+		state := block.StartContext(anydiff.NewConst(in1), 2)
+		expected := block.Step(block.Step(state, in1).State(), in2).Output()
+
+		diff := actual.Copy()
+		diff.Sub(expected)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		inSeq, inVars := randomTestSequence(3)
+		checker := &anydifftest.SeqChecker{
+			F: func() anyseq.Seq {
+				return anyrnn.Map(inSeq, model)
+			},
+			V: append(inVars, model.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+
+	t.Run("Serialize", func(t *testing.T) {
+		data, err := serializer.SerializeAny(model)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded *ContextBlock
+		if err := serializer.DeserializeAny(data, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		expected := model.Step(model.Start(2), in1).Output()
+		actual := decoded.Step(decoded.Start(2), in1).Output()
+		diff := actual.Copy()
+		diff.Sub(expected)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+		}
+	})
+}
@@ -0,0 +1,225 @@
+package sgdstore
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
+)
+
+// ConvLayer describes the spatial structure of a
+// convolutional layer in a storage network.
+//
+// Inputs are row-major images with the depth as the
+// innermost dimension, as in anyconv.
+// A convolutional layer's weights are stored as a matrix
+// with one row per output channel, where each row is a
+// flattened filter (in the same layout as the input).
+// There is one bias per output channel.
+// No padding is used.
+//
+// The patch index maps are cached, so a ConvLayer should
+// not be modified after it is first used.
+type ConvLayer struct {
+	InWidth  int
+	InHeight int
+	InDepth  int
+
+	FilterWidth  int
+	FilterHeight int
+
+	// Stride is the step between filter positions in both
+	// dimensions.
+	// A Stride of 0 is treated as 1.
+	Stride int
+
+	lock    sync.Mutex
+	mappers map[convMapperKey]anyvec.Mapper
+}
+
+type convMapperKey struct {
+	Creator   anyvec.Creator
+	NumImages int
+}
+
+// InSize returns the size of an input image.
+func (c *ConvLayer) InSize() int {
+	return c.InWidth * c.InHeight * c.InDepth
+}
+
+// FilterSize returns the number of weights in a filter.
+func (c *ConvLayer) FilterSize() int {
+	return c.FilterWidth * c.FilterHeight * c.InDepth
+}
+
+// OutWidth returns the width of the output image.
+func (c *ConvLayer) OutWidth() int {
+	return (c.InWidth-c.FilterWidth)/c.stride() + 1
+}
+
+// OutHeight returns the height of the output image.
+func (c *ConvLayer) OutHeight() int {
+	return (c.InHeight-c.FilterHeight)/c.stride() + 1
+}
+
+// NumPatches returns the number of filter positions,
+// which is the number of pixels in the output image.
+func (c *ConvLayer) NumPatches() int {
+	return c.OutWidth() * c.OutHeight()
+}
+
+func (c *ConvLayer) stride() int {
+	if c.Stride == 0 {
+		return 1
+	}
+	return c.Stride
+}
+
+// patches extracts every filter-sized patch from a batch
+// of images (i.e. im2col).
+// The result contains NumPatches() rows of size
+// FilterSize() for each image.
+func (c *ConvLayer) patches(images anydiff.Res, numImages int) anydiff.Res {
+	if images.Output().Len() != numImages*c.InSize() {
+		panic(fmt.Sprintf("image size %d should be %d",
+			images.Output().Len()/numImages, c.InSize()))
+	}
+	return newMapRes(images, c.mapper(images.Output().Creator(), numImages), false)
+}
+
+// unpatches is the transpose of patches, summing the
+// patches back into a batch of images.
+func (c *ConvLayer) unpatches(patches anydiff.Res) anydiff.Res {
+	numImages := patches.Output().Len() / (c.NumPatches() * c.FilterSize())
+	return newMapRes(patches, c.mapper(patches.Output().Creator(), numImages), true)
+}
+
+// mapper returns a Mapper from a batch of images to
+// their patches, creating and caching it if necessary.
+func (c *ConvLayer) mapper(cr anyvec.Creator, numImages int) anyvec.Mapper {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	key := convMapperKey{Creator: cr, NumImages: numImages}
+	if m, ok := c.mappers[key]; ok {
+		return m
+	}
+	indices := c.patchIndices()
+	table := make([]int, 0, numImages*len(indices))
+	for i := 0; i < numImages; i++ {
+		for _, idx := range indices {
+			table = append(table, i*c.InSize()+idx)
+		}
+	}
+	m := cr.MakeMapper(numImages*c.InSize(), table)
+	if c.mappers == nil {
+		c.mappers = map[convMapperKey]anyvec.Mapper{}
+	}
+	c.mappers[key] = m
+	return m
+}
+
+// patchIndices computes the index in an input image of
+// each component of each patch.
+func (c *ConvLayer) patchIndices() []int {
+	res := make([]int, 0, c.NumPatches()*c.FilterSize())
+	for y := 0; y < c.OutHeight(); y++ {
+		for x := 0; x < c.OutWidth(); x++ {
+			for fy := 0; fy < c.FilterHeight; fy++ {
+				for fx := 0; fx < c.FilterWidth; fx++ {
+					row := y*c.stride() + fy
+					col := x*c.stride() + fx
+					start := (row*c.InWidth + col) * c.InDepth
+					for z := 0; z < c.InDepth; z++ {
+						res = append(res, start+z)
+					}
+				}
+			}
+		}
+	}
+	return res
+}
+
+// convLayerInts encodes a list of (possibly nil)
+// convolutional layers as integers.
+func convLayerInts(layers []*ConvLayer) []int {
+	var res []int
+	for _, l := range layers {
+		if l == nil {
+			l = &ConvLayer{}
+		}
+		res = append(res, l.InWidth, l.InHeight, l.InDepth, l.FilterWidth,
+			l.FilterHeight, l.Stride)
+	}
+	return res
+}
+
+// convLayersFromInts decodes the result of convLayerInts.
+func convLayersFromInts(ints []int) ([]*ConvLayer, error) {
+	if len(ints)%6 != 0 {
+		return nil, fmt.Errorf("invalid number of conv fields: %d", len(ints))
+	}
+	var res []*ConvLayer
+	for i := 0; i < len(ints); i += 6 {
+		l := &ConvLayer{
+			InWidth:      ints[i],
+			InHeight:     ints[i+1],
+			InDepth:      ints[i+2],
+			FilterWidth:  ints[i+3],
+			FilterHeight: ints[i+4],
+			Stride:       ints[i+5],
+		}
+		if l.InWidth == 0 {
+			l = nil
+		}
+		res = append(res, l)
+	}
+	return res, nil
+}
+
+// mapRes applies an anyvec.Mapper, or its transpose,
+// to a batch of vectors.
+type mapRes struct {
+	In        anydiff.Res
+	Mapper    anyvec.Mapper
+	Transpose bool
+	OutVec    anyvec.Vector
+}
+
+func newMapRes(in anydiff.Res, m anyvec.Mapper, transpose bool) *mapRes {
+	return &mapRes{
+		In:        in,
+		Mapper:    m,
+		Transpose: transpose,
+		OutVec:    applyMapper(m, in.Output(), transpose),
+	}
+}
+
+func (m *mapRes) Output() anyvec.Vector {
+	return m.OutVec
+}
+
+func (m *mapRes) Vars() anydiff.VarSet {
+	return m.In.Vars()
+}
+
+func (m *mapRes) Propagate(u anyvec.Vector, g anydiff.Grad) {
+	if !g.Intersects(m.In.Vars()) {
+		return
+	}
+	m.In.Propagate(applyMapper(m.Mapper, u, !m.Transpose), g)
+}
+
+// applyMapper maps in to a new vector.
+// In the transposed direction, components which appear
+// more than once in the table are summed.
+func applyMapper(m anyvec.Mapper, in anyvec.Vector, transpose bool) anyvec.Vector {
+	if transpose {
+		out := in.Creator().MakeVector(m.InSize())
+		m.MapTranspose(in, out)
+		return out
+	}
+	out := in.Creator().MakeVector(m.OutSize())
+	m.Map(in, out)
+	return out
+}
@@ -0,0 +1,142 @@
+package sgdstore
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anydifftest"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestConvApply(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	conv := &ConvLayer{
+		InWidth:      5,
+		InHeight:     4,
+		InDepth:      2,
+		FilterWidth:  3,
+		FilterHeight: 2,
+		Stride:       2,
+	}
+	weights := c.MakeVector(3 * conv.FilterSize())
+	biases := c.MakeVector(3)
+	images := c.MakeVector(2 * conv.InSize())
+	for _, v := range []anyvec.Vector{weights, biases, images} {
+		anyvec.Rand(v, anyvec.Normal, nil)
+	}
+	net := &Net{
+		Parameters: anydiff.Fuse(anydiff.NewConst(weights), anydiff.NewConst(biases)),
+		Num:        1,
+		Activation: Tanh,
+		Conv:       []*ConvLayer{conv},
+	}
+	actual := vecFloats(net.Apply(anydiff.NewConst(images), 2).Output())
+
+	w, b, in := vecFloats(weights), vecFloats(biases), vecFloats(images)
+	var expected []float64
+	for img := 0; img < 2; img++ {
+		for y := 0; y < conv.OutHeight(); y++ {
+			for x := 0; x < conv.OutWidth(); x++ {
+				for ch := 0; ch < 3; ch++ {
+					sum := b[ch]
+					var idx int
+					for fy := 0; fy < conv.FilterHeight; fy++ {
+						for fx := 0; fx < conv.FilterWidth; fx++ {
+							for z := 0; z < conv.InDepth; z++ {
+								pixel := ((y*2+fy)*conv.InWidth + x*2 + fx) * conv.InDepth
+								sum += w[ch*conv.FilterSize()+idx] *
+									in[img*conv.InSize()+pixel+z]
+								idx++
+							}
+						}
+					}
+					expected = append(expected, math.Tanh(sum))
+				}
+			}
+		}
+	}
+
+	if len(actual) != len(expected) {
+		t.Fatalf("expected length %d but got %d", len(expected), len(actual))
+	}
+	for i, x := range expected {
+		if math.Abs(x-actual[i]) > 1e-4 {
+			t.Fatalf("expected %v but got %v", expected, actual)
+		}
+	}
+}
+
+func TestConvTrain(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	conv := &ConvLayer{
+		InWidth:      3,
+		InHeight:     3,
+		InDepth:      1,
+		FilterWidth:  2,
+		FilterHeight: 2,
+	}
+	var params []*anydiff.Var
+	for _, size := range []int{2 * 4, 2, 2 * 8, 2} {
+		// Two networks with the given parameter sizes.
+		v := anydiff.NewVar(c.MakeVector(size * 2))
+		anyvec.Rand(v.Vector, anyvec.Normal, nil)
+		params = append(params, v)
+	}
+	input := anydiff.NewVar(c.MakeVector(2 * 3 * 9))
+	target := anydiff.NewVar(c.MakeVector(2 * 3 * 2))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1, 0.2}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	checker := &anydifftest.ResChecker{
+		F: func() anydiff.Res {
+			var paramReses []anydiff.Res
+			for _, p := range params {
+				paramReses = append(paramReses, p)
+			}
+			net := &Net{
+				Parameters: anydiff.Fuse(paramReses...),
+				Num:        2,
+				Activation: Tanh,
+				Conv:       []*ConvLayer{conv},
+			}
+			trained := net.Train(input, target, stepSize, 3, 2)
+			return anydiff.Unfuse(trained.Parameters,
+				func(params []anydiff.Res) anydiff.Res {
+					return anydiff.Concat(append(params, trained.Apply(input, 3))...)
+				})
+		},
+		V: append([]*anydiff.Var{input, target, stepSize}, params...),
+	}
+	checker.FullCheck(t)
+}
+
+func TestConvBlock(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	convs := []*ConvLayer{
+		{InWidth: 4, InHeight: 3, InDepth: 1, FilterWidth: 2, FilterHeight: 2},
+		{InWidth: 3, InHeight: 2, InDepth: 2, FilterWidth: 2, FilterHeight: 2},
+	}
+	block := ConvBlock(c, 3, 2, 2, 1, 0.1, Tanh, convs, []int{2, 2}, 3)
+	if block.Query.Apply(anydiff.NewConst(c.MakeVector(3)), 1).Output().Len() != 2*12 {
+		t.Fatal("unexpected key size")
+	}
+	randomizeParams(block)
+
+	t.Run("Gradients", func(t *testing.T) {
+		checkBlockGradients(t, block)
+	})
+
+	t.Run("Rehearsal", func(t *testing.T) {
+		rehearsing := *block
+		rehearsing.Rehearsal = 3
+		buffer := rehearsing.Start(1).(*State).Buffer
+		if buffer[0].Vector.Len() != 3*12 || buffer[1].Vector.Len() != 3*3 {
+			t.Fatalf("unexpected buffer sizes %d and %d", buffer[0].Vector.Len(),
+				buffer[1].Vector.Len())
+		}
+		checkBlockGradients(t, &rehearsing)
+	})
+}
@@ -0,0 +1,476 @@
+package sgdstore
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvecsave"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer((&DualBlock{}).SerializerType(),
+		DeserializeDualBlock)
+}
+
+// DualBlock is an RNN block with two memories that
+// operate on different timescales.
+//
+// The fast memory is a Block which is written to at every
+// timestep.
+// The slow memory is a storage network with the same
+// architecture, which is only updated during periodic
+// consolidation phases.
+// During consolidation, the slow network is trained (with
+// SlowStepSize) to match the fast network's outputs on a
+// buffer of recent queries, and the fast network is
+// decayed towards its start parameters.
+//
+// Every query reads from both memories, so the output of
+// a DualBlock is the output of the fast Block followed
+// by the slow network's outputs for each sequence.
+// The slow reads follow Fast.Aggregation, and
+// Fast.ReadMode determines whether they happen before
+// or after consolidation.
+//
+// If Fast.CheckFinite is set, consolidation is checked as
+// well, and problems in the slow network are reported by
+// the FiniteErr field of the fast State with a "slow "
+// value prefix.
+type DualBlock struct {
+	Fast *Block
+
+	// SlowInit contains the initial parameters of the slow
+	// network, in the same format as Fast.InitParams.
+	SlowInit []*anydiff.Var
+
+	// SlowStepSize is the step size for consolidation.
+	SlowStepSize float64
+
+	// FastDecay is the amount by which the fast memory is
+	// interpolated towards its start parameters (either
+	// Fast.InitParams or the parameters generated by
+	// Fast.InitNet) after consolidation.
+	// A value of 1 resets the fast memory.
+	FastDecay float64
+
+	// Period is the number of timesteps between
+	// consolidation phases.
+	// If it is 0, no consolidation takes place.
+	Period int
+
+	// DistillSteps is the number of SGD steps taken by
+	// the slow network during consolidation.
+	DistillSteps int
+
+	// ReplaySize is the number of recent queries (per
+	// sequence) on which to consolidate.
+	ReplaySize int
+}
+
+// NewDualBlock creates a DualBlock with a slow memory
+// that starts out as a copy of the fast memory.
+func NewDualBlock(fast *Block, slowStepSize, fastDecay float64, period, distillSteps,
+	replaySize int) *DualBlock {
+	if fast.Experts != 0 || fast.Ensemble != 0 {
+		panic("experts and ensembles are not supported in a DualBlock")
+	}
+	res := &DualBlock{
+		Fast:         fast,
+		SlowStepSize: slowStepSize,
+		FastDecay:    fastDecay,
+		Period:       period,
+		DistillSteps: distillSteps,
+		ReplaySize:   replaySize,
+	}
+	for _, p := range fast.InitParams {
+		res.SlowInit = append(res.SlowInit, anydiff.NewVar(p.Vector.Copy()))
+	}
+	return res
+}
+
+// DeserializeDualBlock deserializes a DualBlock.
+func DeserializeDualBlock(d []byte) (block *DualBlock, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.DualBlock", &err)
+	var vecData []byte
+	block = &DualBlock{}
+	err = serializer.DeserializeAny(d, &block.Fast, &vecData, &block.SlowStepSize,
+		&block.FastDecay, &block.Period, &block.DistillSteps, &block.ReplaySize)
+	if err != nil {
+		return nil, err
+	}
+	if block.Fast.Experts != 0 || block.Fast.Ensemble != 0 {
+		return nil, errors.New("experts and ensembles are not supported in a DualBlock")
+	}
+	savedVecs, err := serializer.DeserializeSlice(vecData)
+	if err != nil {
+		return nil, err
+	}
+	for _, vecObj := range savedVecs {
+		if vec, ok := vecObj.(*anyvecsave.S); ok {
+			block.SlowInit = append(block.SlowInit, anydiff.NewVar(vec.Vector))
+		} else {
+			return nil, fmt.Errorf("expected vector but got %T", vecObj)
+		}
+	}
+	return block, nil
+}
+
+// Start produces a start state.
+func (d *DualBlock) Start(n int) anyrnn.State {
+	slow := &State{}
+	for _, p := range d.SlowInit {
+		slow.Params = append(slow.Params, anyrnn.NewVecState(p.Vector, n))
+	}
+	c := d.SlowInit[0].Vector.Creator()
+	replay := c.MakeVector(d.ReplaySize * d.Fast.keySize())
+	slow.Buffer = []*anyrnn.VecState{anyrnn.NewVecState(replay, n)}
+	return &DualState{
+		Fast: d.Fast.Start(n).(*State),
+		Slow: slow,
+	}
+}
+
+// PropagateStart propagates through the start state.
+func (d *DualBlock) PropagateStart(s anyrnn.StateGrad, g anydiff.Grad) {
+	state := s.(*DualState)
+	d.Fast.PropagateStart(state.Fast, g)
+	for i, paramVar := range d.SlowInit {
+		state.Slow.Params[i].PropagateStart(paramVar, g)
+	}
+}
+
+// Step evaluates the block.
+func (d *DualBlock) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
+	state := s.(*DualState)
+	present := state.Present()
+	n := present.NumPresent()
+	timestep := state.Slow.Timestep
+
+	// The fast Block shares our queries, so that the Query
+	// gate is only applied once.
+	inPool := anydiff.NewVar(in)
+	query := d.Fast.Query.Apply(inPool, n)
+	fastRes := d.Fast.step(state.Fast, in, query)
+	fastState := fastRes.State().(*State)
+
+	fastOutPool := anydiff.NewVar(fastRes.Output())
+	fastPools := (&State{Params: fastState.Params, Origin: fastState.Origin}).pool()
+	slowPools := state.Slow.pool()
+	numParams := len(fastState.Params)
+
+	var check *finiteChecker
+	if d.Fast.CheckFinite {
+		check = &finiteChecker{Timestep: timestep, Prefix: "slow "}
+		for i, pres := range present {
+			if pres {
+				check.Sequences = append(check.Sequences, i)
+			}
+		}
+	}
+
+	consolidating := d.Period != 0 && (timestep+1)%d.Period == 0
+	allRes := anydiff.PoolFork(query, func(query anydiff.Res) anydiff.MultiRes {
+		fastParams := make([]anydiff.Res, numParams)
+		slowParams := make([]anydiff.Res, numParams)
+		for i := range fastParams {
+			fastParams[i] = fastPools[i]
+			slowParams[i] = slowPools[i]
+		}
+		var fastOrigin []anydiff.Res
+		for _, pool := range fastPools[numParams:] {
+			fastOrigin = append(fastOrigin, pool)
+		}
+		replay := slowPools[numParams]
+		fastNet := &Net{
+			Parameters:    anydiff.Fuse(fastParams...),
+			Num:           n,
+			Activation:    d.Fast.Activation,
+			LinearOutput:  d.Fast.Ridge != nil,
+			Conv:          d.Fast.Conv,
+			NormKeys:      d.Fast.NormKeys,
+			Embedding:     d.Fast.Embedding,
+			EmbeddingTopK: d.Fast.EmbeddingTopK,
+		}
+		slowNet := fastNet.withParameters(anydiff.Fuse(slowParams...))
+		slowNet.check = check
+
+		queryBatch := query.Output().Len() / (d.Fast.keySize() * n)
+		var before anydiff.Res
+		if !consolidating || d.Fast.ReadMode != ReadAfterWrite {
+			before = d.Fast.read(slowNet, query, n, queryBatch)
+		}
+		newReplay := batchedSlice(batchedConcat(n, query, replay), n, 0,
+			replay.Output().Len()/n)
+
+		if !consolidating {
+			res := append([]anydiff.Res{d.output(n, fastOutPool, before, before)},
+				fastParams...)
+			res = append(res, slowParams...)
+			res = append(res, newReplay)
+			return anydiff.Fuse(append(res, fastOrigin...)...)
+		}
+
+		return anydiff.PoolFork(newReplay, func(newReplay anydiff.Res) anydiff.MultiRes {
+			newSlow, newFast := d.consolidate(fastParams, fastOrigin, fastNet, slowNet,
+				newReplay, (timestep+1)*queryBatch)
+			return anydiff.PoolMulti(newSlow, func(newSlow []anydiff.Res) anydiff.MultiRes {
+				var after anydiff.Res
+				if d.Fast.ReadMode != ReadBeforeWrite {
+					after = d.Fast.read(slowNet.withParameters(anydiff.Fuse(newSlow...)),
+						query, n, queryBatch)
+				}
+				res := append([]anydiff.Res{d.output(n, fastOutPool, before, after)},
+					newFast...)
+				res = append(res, newSlow...)
+				res = append(res, newReplay)
+				return anydiff.Fuse(append(res, fastOrigin...)...)
+			})
+		})
+	})
+
+	outs := allRes.Outputs()
+	numFast := len(fastPools)
+	newFast := make([]*anyrnn.VecState, 0, numFast+len(fastState.Buffer))
+	newSlow := make([]*anyrnn.VecState, numParams+1)
+	for i := 0; i < numParams; i++ {
+		newFast = append(newFast, &anyrnn.VecState{PresentMap: present, Vector: outs[1+i]})
+	}
+	newFast = append(newFast, fastState.Buffer...)
+	for i := range newSlow {
+		newSlow[i] = &anyrnn.VecState{PresentMap: present, Vector: outs[1+numParams+i]}
+	}
+	for _, vec := range outs[2+2*numParams:] {
+		newFast = append(newFast, &anyrnn.VecState{PresentMap: present, Vector: vec})
+	}
+	newState := &DualState{
+		Fast: fastState.withVecs(newFast),
+		Slow: state.Slow.withVecs(newSlow),
+	}
+	newState.Slow.Timestep++
+	if check != nil && newState.Fast.FiniteErr == nil {
+		newState.Fast.FiniteErr = check.Err
+	}
+
+	return &dualRes{
+		FastRes:     fastRes,
+		FastState:   fastState,
+		InPool:      inPool,
+		FastOutPool: fastOutPool,
+		FastPools:   fastPools,
+		SlowPools:   slowPools,
+		OutState:    newState,
+		AllRes:      allRes,
+		V:           anydiff.NewVarSet(d.Parameters()...),
+	}
+}
+
+// Parameters returns the parameters of the fast Block
+// and the initial slow parameters.
+func (d *DualBlock) Parameters() []*anydiff.Var {
+	return append(d.Fast.Parameters(), d.SlowInit...)
+}
+
+// SerializerType returns the unique ID used to serialize
+// a DualBlock with the serializer package.
+func (d *DualBlock) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.DualBlock"
+}
+
+// Serialize serializes the block.
+func (d *DualBlock) Serialize() ([]byte, error) {
+	var savedVecs []serializer.Serializer
+	for _, v := range d.SlowInit {
+		savedVecs = append(savedVecs, &anyvecsave.S{Vector: v.Vector})
+	}
+	vecData, err := serializer.SerializeSlice(savedVecs)
+	if err != nil {
+		return nil, err
+	}
+	return serializer.SerializeAny(
+		d.Fast,
+		serializer.Bytes(vecData),
+		d.SlowStepSize,
+		d.FastDecay,
+		d.Period,
+		d.DistillSteps,
+		d.ReplaySize,
+	)
+}
+
+// output joins the fast Block's output with the slow
+// network's reads from before and after consolidation,
+// according to Fast.ReadMode.
+func (d *DualBlock) output(n int, fastOut, before, after anydiff.Res) anydiff.Res {
+	switch d.Fast.ReadMode {
+	case ReadBeforeWrite:
+		return batchedConcat(n, fastOut, before)
+	case ReadBeforeAndAfter:
+		return batchedConcat(n, fastOut, before, after)
+	default:
+		return batchedConcat(n, fastOut, after)
+	}
+}
+
+// consolidate distills the fast network into the slow
+// network using the valid queries in the replay buffer.
+// It returns the new slow parameters and the fast
+// parameters, decayed towards fastOrigin (or towards
+// Fast.InitParams if fastOrigin is empty).
+//
+// The networks, the origin, and the replay buffer should
+// be pooled by the caller.
+func (d *DualBlock) consolidate(fastParams, fastOrigin []anydiff.Res, fastNet,
+	slowNet *Net, replay anydiff.Res, numQueries int) (anydiff.MultiRes, []anydiff.Res) {
+	n := fastNet.Num
+	if numQueries > d.ReplaySize {
+		numQueries = d.ReplaySize
+	}
+	c := replay.Output().Creator()
+	stepSizes := c.MakeVector(n)
+	stepSizes.AddScalar(c.MakeNumeric(d.SlowStepSize))
+
+	replayIn := batchedSlice(replay, n, 0, numQueries*d.Fast.keySize())
+	newSlow := anydiff.PoolMulti(anydiff.Fuse(replayIn),
+		func(replayIn []anydiff.Res) anydiff.MultiRes {
+			targets := fastNet.Apply(replayIn[0], numQueries)
+			return slowNet.Train(replayIn[0], targets, anydiff.NewConst(stepSizes),
+				numQueries, d.DistillSteps).Parameters
+		})
+
+	amounts := c.MakeVector(n)
+	amounts.AddScalar(c.MakeNumeric(d.FastDecay))
+	newFast := d.Fast.reset(fastParams, fastOrigin, anydiff.NewConst(amounts), n)
+	return newSlow, newFast
+}
+
+// DualState is the anyrnn.State and anyrnn.StateGrad type
+// for a DualBlock.
+type DualState struct {
+	Fast *State
+
+	// Slow stores the slow network's parameters, and its
+	// Buffer stores the replayed queries.
+	Slow *State
+}
+
+// Present returns the present sequence map.
+func (d *DualState) Present() anyrnn.PresentMap {
+	return d.Fast.Present()
+}
+
+// Reduce removes states.
+func (d *DualState) Reduce(p anyrnn.PresentMap) anyrnn.State {
+	return &DualState{
+		Fast: d.Fast.Reduce(p).(*State),
+		Slow: d.Slow.Reduce(p).(*State),
+	}
+}
+
+// Expand inserts gradients.
+func (d *DualState) Expand(p anyrnn.PresentMap) anyrnn.StateGrad {
+	return &DualState{
+		Fast: d.Fast.Expand(p).(*State),
+		Slow: d.Slow.Expand(p).(*State),
+	}
+}
+
+type dualRes struct {
+	FastRes   anyrnn.Res
+	FastState *State
+
+	InPool      *anydiff.Var
+	FastOutPool *anydiff.Var
+	FastPools   []*anydiff.Var
+	SlowPools   []*anydiff.Var
+
+	OutState *DualState
+	AllRes   anydiff.MultiRes
+	V        anydiff.VarSet
+}
+
+func (d *dualRes) State() anyrnn.State {
+	return d.OutState
+}
+
+func (d *dualRes) Output() anyvec.Vector {
+	return d.AllRes.Outputs()[0]
+}
+
+func (d *dualRes) Vars() anydiff.VarSet {
+	return d.V
+}
+
+func (d *dualRes) Propagate(u anyvec.Vector, s anyrnn.StateGrad,
+	g anydiff.Grad) (anyvec.Vector, anyrnn.StateGrad) {
+	numParams := len(d.FastState.Params)
+	allUpstream := make([]anyvec.Vector, len(d.AllRes.Outputs()))
+	allUpstream[0] = u
+	var fastBuffer []*anyrnn.VecState
+	if s != nil {
+		sg := s.(*DualState)
+		for i, vec := range sg.Fast.Params {
+			allUpstream[1+i] = vec.Vector
+		}
+		for i, vec := range sg.Slow.vecs() {
+			allUpstream[1+numParams+i] = vec.Vector
+		}
+		for i, vec := range sg.Fast.Origin {
+			allUpstream[2+2*numParams+i] = vec.Vector
+		}
+		fastBuffer = sg.Fast.Buffer
+	} else {
+		for _, vec := range d.FastState.Buffer {
+			fastBuffer = append(fastBuffer, &anyrnn.VecState{
+				PresentMap: vec.PresentMap,
+				Vector:     u.Creator().MakeVector(vec.Vector.Len()),
+			})
+		}
+	}
+	for i, x := range allUpstream {
+		if x == nil {
+			allUpstream[i] = u.Creator().MakeVector(d.AllRes.Outputs()[i].Len())
+		}
+	}
+
+	for _, p := range d.pools() {
+		g[p] = p.Vector.Creator().MakeVector(p.Vector.Len())
+		defer func(g anydiff.Grad, p *anydiff.Var) {
+			delete(g, p)
+		}(g, p)
+	}
+
+	d.AllRes.Propagate(allUpstream, g)
+
+	present := d.OutState.Present()
+	fastGrad := make([]*anyrnn.VecState, len(d.FastPools))
+	for i, pool := range d.FastPools {
+		fastGrad[i] = &anyrnn.VecState{PresentMap: present, Vector: g[pool]}
+	}
+	slowGrad := make([]*anyrnn.VecState, len(d.SlowPools))
+	for i, pool := range d.SlowPools {
+		slowGrad[i] = &anyrnn.VecState{PresentMap: present, Vector: g[pool]}
+	}
+
+	// The fast pools hold the parameters and the origin,
+	// but the fast State puts the buffer in between.
+	fastVecs := append(fastGrad[:numParams:numParams], fastBuffer...)
+	fastUpstream := d.FastState.withVecs(append(fastVecs, fastGrad[numParams:]...))
+	inGrad, fastDown := d.FastRes.Propagate(g[d.FastOutPool], fastUpstream, g)
+	inGrad.Add(g[d.InPool])
+
+	return inGrad, &DualState{
+		Fast: fastDown.(*State),
+		Slow: d.OutState.Slow.withVecs(slowGrad),
+	}
+}
+
+func (d *dualRes) pools() []*anydiff.Var {
+	res := []*anydiff.Var{d.InPool, d.FastOutPool}
+	res = append(res, d.FastPools...)
+	return append(res, d.SlowPools...)
+}
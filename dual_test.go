@@ -0,0 +1,131 @@
+package sgdstore
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestDualBlockGradients(t *testing.T) {
+	block := NewDualBlock(testBlock(), 0.3, 0.5, 2, 2, 3)
+	for _, param := range block.SlowInit {
+		anyvec.Rand(param.Vector, anyvec.Normal, nil)
+	}
+	randomizeParams(block.Fast)
+	checkBlockGradients(t, block)
+}
+
+func TestDualBlockConsolidate(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := NewDualBlock(testBlock(), 0.3, 1, 2, 2, 3)
+	randomizeParams(block.Fast)
+	in := c.MakeVectorData([]float64{0.3, 0.5, -0.3})
+
+	state := block.Start(1)
+	for i := 0; i < 2; i++ {
+		state = block.Step(state, in).State()
+		fastParams := state.(*DualState).Fast.Params
+		slowParams := state.(*DualState).Slow.Params
+		for j, param := range block.Fast.InitParams {
+			diff := fastParams[j].Vector.Copy()
+			diff.Sub(param.Vector)
+			fastReset := anyvec.AbsMax(diff).(float64) < 1e-4
+			diff = slowParams[j].Vector.Copy()
+			diff.Sub(block.SlowInit[j].Vector)
+			slowChanged := anyvec.AbsMax(diff).(float64) > 1e-4
+			if (i == 1) != fastReset {
+				t.Errorf("step %d param %d: unexpected fast reset state %v", i, j, fastReset)
+			}
+			if (i == 1) != slowChanged {
+				t.Errorf("step %d param %d: unexpected slow change %v", i, j, slowChanged)
+			}
+		}
+	}
+}
+
+func TestDualBlockCheckFinite(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := NewDualBlock(testBlock(), 0.3, 0.5, 1, 2, 3)
+	block.Fast.CheckFinite = true
+	randomizeParams(block.Fast)
+	block.SlowInit[1].Vector.SetData([]float64{math.Inf(1), 0})
+	watcher := WatchFinite(block)
+	in := c.MakeVectorData([]float64{0.3, 0.5, -0.3})
+	res := watcher.RNN.Step(watcher.RNN.Start(1), in)
+
+	expected := &NonFiniteError{
+		Sequence:  0,
+		Timestep:  0,
+		InnerStep: 0,
+		Layer:     0,
+		Value:     "slow weight gradient",
+	}
+	if err := res.State().(*DualState).Fast.FiniteErr; err == nil || *err != *expected {
+		t.Errorf("expected %v but got %v", expected, err)
+	}
+	if err, ok := watcher.Err().(*NonFiniteError); !ok || *err != *expected {
+		t.Errorf("expected %v but got %v", expected, watcher.Err())
+	}
+
+	watcher.Reset()
+	if err := watcher.Err(); err != nil {
+		t.Errorf("unexpected error after reset: %v", err)
+	}
+}
+
+func TestDualBlockOverrideSteps(t *testing.T) {
+	block := NewDualBlock(testBlock(), 0.3, 0.5, 2, 2, 3)
+	restore := OverrideSteps(block, 5, 2)
+	if block.Fast.Steps != 5 || block.DistillSteps != 2 || block.SlowStepSize != 0.6 {
+		t.Errorf("unexpected overrides: steps=%d distill=%d slow step=%f",
+			block.Fast.Steps, block.DistillSteps, block.SlowStepSize)
+	}
+	restore()
+	if block.Fast.Steps != 1 || block.DistillSteps != 2 || block.SlowStepSize != 0.3 {
+		t.Errorf("unexpected restored values: steps=%d distill=%d slow step=%f",
+			block.Fast.Steps, block.DistillSteps, block.SlowStepSize)
+	}
+}
+
+func TestDualBlockReadModes(t *testing.T) {
+	modes := []ReadMode{ReadAfterWrite, ReadBeforeWrite, ReadBeforeAndAfter}
+	for _, mode := range modes {
+		block := NewDualBlock(testBlock(), 0.3, 0.5, 1, 2, 3)
+		block.Fast.ReadMode = mode
+		block.Fast.Aggregation = MeanQueries
+		for _, param := range block.SlowInit {
+			anyvec.Rand(param.Vector, anyvec.Normal, nil)
+		}
+		randomizeParams(block.Fast)
+		checkBlockGradients(t, block)
+	}
+}
+
+func TestDualBlockDecayOrigin(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	fast := testBlock()
+	fast.InitNet = anynet.NewFC(c, 3, 4*2+2)
+	randomizeParams(fast)
+	block := NewDualBlock(fast, 0.3, 1, 1, 2, 3)
+	in := c.MakeVectorData([]float64{0.3, 0.5, -0.3})
+
+	state := block.Start(1).(*DualState)
+	state.Fast = fast.StartContext(anydiff.NewConst(in), 1).(*State)
+	newState := block.Step(state, in).State().(*DualState)
+	if len(newState.Fast.Origin) != len(state.Fast.Origin) {
+		t.Fatalf("expected %d origin vectors but got %d", len(state.Fast.Origin),
+			len(newState.Fast.Origin))
+	}
+	for i, origin := range state.Fast.Origin {
+		diff := newState.Fast.Params[i].Vector.Copy()
+		diff.Sub(origin.Vector)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("param %d: expected %v but got %v", i, origin.Vector.Data(),
+				newState.Fast.Params[i].Vector.Data())
+		}
+	}
+}
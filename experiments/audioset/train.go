@@ -20,6 +20,7 @@ import (
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/rip"
 	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/sgdstore"
 )
 
 func Train(args []string) {
@@ -35,6 +36,9 @@ func Train(args []string) {
 	var sgdSteps int
 	var numClasses int
 	var episodeLen int
+	var evalSteps int
+	var evalStepScale float64
+	var checkFinite bool
 
 	var audioFeatureSize int
 	var pcmChunkSize int
@@ -54,6 +58,9 @@ func Train(args []string) {
 	fs.IntVar(&sgdSteps, "steps", 1, "steps per sgdstore")
 	fs.IntVar(&numClasses, "classes", 5, "classes per episode")
 	fs.IntVar(&episodeLen, "eplen", 50, "episode length")
+	fs.IntVar(&evalSteps, "evalsteps", 0, "steps per sgdstore for validation (0 to keep)")
+	fs.Float64Var(&evalStepScale, "evalstepscale", 1, "sgdstore step size scale for validation")
+	fs.BoolVar(&checkFinite, "checkfinite", false, "stop if sgdstore produces NaN or Inf")
 
 	fs.IntVar(&audioFeatureSize, "audiofeats", 128, "audio feature vector size")
 	fs.IntVar(&pcmChunkSize, "chunksize", 512, "PCM sample chunk size")
@@ -78,6 +85,10 @@ func Train(args []string) {
 		log.Println("Loaded feature net.")
 	}
 
+	for _, block := range sgdstore.FindBlocks(learner) {
+		block.CheckFinite = checkFinite
+	}
+
 	allSamples, err := audioset.ReadSet(dataDir, dataCSV)
 	if err != nil {
 		essentials.Die(err)
@@ -88,13 +99,14 @@ func Train(args []string) {
 	log.Printf("Got %d samples: %d training, %d eval", len(allSamples), len(training),
 		len(eval))
 
+	finite := sgdstore.WatchFinite(learner)
 	trainer := &metaset.Trainer{
 		Creator: anyvec32.CurrentCreator(),
 		FeatureFunc: func(seq anyseq.Seq) anydiff.Res {
 			return anyseq.Tail(anyrnn.Map(seq, features))
 		},
 		LearnerFunc: func(eps anyseq.Seq) anyseq.Seq {
-			return anyrnn.Map(eps, learner)
+			return anyrnn.Map(eps, finite.RNN)
 		},
 		Params:     anynet.AllParameters(learner, features),
 		Set:        training,
@@ -115,9 +127,14 @@ func Train(args []string) {
 		Rater:       anysgd.ConstRater(stepSize),
 		BatchSize:   batchSize,
 		StatusFunc: func(b anysgd.Batch) {
+			if err := finite.Err(); err != nil {
+				essentials.Die("not saving model:", err)
+			}
 			if iter%4 == 0 {
 				batch := <-valBatches
+				restore := sgdstore.OverrideSteps(learner, evalSteps, evalStepScale)
 				valCost := anyvec.Sum(trainer.TotalCost(batch).Output())
+				restore()
 				log.Printf("iter %d: cost=%v validation=%v", iter, trainer.LastCost,
 					valCost)
 			} else {
@@ -131,6 +148,9 @@ func Train(args []string) {
 		fmt.Fprintln(os.Stderr, err)
 	}
 
+	if err := finite.Err(); err != nil {
+		essentials.Die("not saving model:", err)
+	}
 	if err := serializer.SaveAny(learnerNetPath, learner); err != nil {
 		essentials.Die(err)
 	}
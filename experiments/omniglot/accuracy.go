@@ -11,6 +11,7 @@ import (
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/omniglot"
 	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/sgdstore"
 )
 
 func Accuracy(args []string) {
@@ -19,6 +20,8 @@ func Accuracy(args []string) {
 	var batchSize int
 	var numClasses int
 	var episodeLen int
+	var sgdSteps int
+	var stepScale float64
 
 	fs := flag.NewFlagSet("accuracy", flag.ExitOnError)
 	fs.StringVar(&modelPath, "model", "model_out", "model path")
@@ -26,6 +29,8 @@ func Accuracy(args []string) {
 	fs.IntVar(&batchSize, "batch", 16, "")
 	fs.IntVar(&numClasses, "classes", 5, "classes per episode")
 	fs.IntVar(&episodeLen, "eplen", 50, "episode length")
+	fs.IntVar(&sgdSteps, "steps", 0, "override steps per sgdstore (0 to keep)")
+	fs.Float64Var(&stepScale, "stepscale", 1, "scale for sgdstore step sizes")
 	fs.Parse(args)
 
 	if dataPath == "" {
@@ -36,6 +41,7 @@ func Accuracy(args []string) {
 	if err := serializer.LoadAny(modelPath, &model); err != nil {
 		essentials.Die(err)
 	}
+	sgdstore.OverrideSteps(model, sgdSteps, stepScale)
 
 	data, err := omniglot.ReadSet(dataPath)
 	if err != nil {
@@ -55,6 +61,9 @@ func Accuracy(args []string) {
 	totalSeen := map[int]int{}
 	totalCorrect := map[int]int{}
 
+	counter := &stepCounter{}
+	model = counter.Wrap(model)
+
 	for {
 		batch, err := tr.Fetch(samples)
 		if err != nil {
@@ -80,6 +89,10 @@ func Accuracy(args []string) {
 		}
 
 		printAccuracies(totalSeen, totalCorrect)
+		if counter.TotalWrites > 0 {
+			fmt.Printf("Mean SGD steps: %.3f\n",
+				float64(counter.TotalSteps)/float64(counter.TotalWrites))
+		}
 	}
 }
 
@@ -89,3 +102,38 @@ func printAccuracies(seen, correct map[int]int) {
 		fmt.Printf("Instance %d: %.2f%%\n", i, percent)
 	}
 }
+
+// stepCounter tallies the SGD steps taken by adaptive
+// sgdstore.Blocks, using the step counts in their states.
+type stepCounter struct {
+	TotalSteps  int
+	TotalWrites int
+}
+
+// Wrap replaces every sgdstore.Block and ContextBlock in
+// an RNN with a block that reports its step counts to c.
+func (c *stepCounter) Wrap(block anyrnn.Block) anyrnn.Block {
+	return sgdstore.MapBlocks(block, func(b anyrnn.Block) anyrnn.Block {
+		switch b.(type) {
+		case *sgdstore.Block, *sgdstore.ContextBlock:
+			return &countedBlock{Block: b, Counter: c}
+		}
+		return b
+	})
+}
+
+// countedBlock wraps an sgdstore.Block or ContextBlock,
+// reporting its step counts to a stepCounter.
+type countedBlock struct {
+	anyrnn.Block
+	Counter *stepCounter
+}
+
+func (c *countedBlock) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
+	res := c.Block.Step(s, in)
+	for _, steps := range res.State().(*sgdstore.State).Steps {
+		c.Counter.TotalSteps += steps
+		c.Counter.TotalWrites++
+	}
+	return res
+}
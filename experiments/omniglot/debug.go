@@ -38,24 +38,18 @@ func Debug(args []string) {
 		essentials.Die(err)
 	}
 
-	stack := model.(anyrnn.Stack)
-	for _, layer := range stack {
-		if par, ok := layer.(*anyrnn.Parallel); ok {
-			layer = par.Block2
+	for _, block := range sgdstore.FindBlocks(model) {
+		if logStepSize {
+			net := block.StepSize.(anynet.Net)
+			block.StepSize = append(net, debugLayer("step"))
 		}
-		if block, ok := layer.(*sgdstore.Block); ok {
-			if logStepSize {
-				net := block.StepSize.(anynet.Net)
-				block.StepSize = append(net, debugLayer("step"))
-			}
-			if logTrainIn {
-				net := block.TrainInput
-				block.TrainInput = anynet.Net{net, debugLayer("train")}
-			}
-			if logTrainTarget {
-				net := block.TrainTarget.(anynet.Net)
-				block.TrainTarget = append(net, debugLayer("target"))
-			}
+		if logTrainIn {
+			net := block.TrainInput
+			block.TrainInput = anynet.Net{net, debugLayer("train")}
+		}
+		if logTrainTarget {
+			net := block.TrainTarget.(anynet.Net)
+			block.TrainTarget = append(net, debugLayer("target"))
 		}
 	}
 
@@ -31,6 +31,103 @@ func NewModel(name string, sgdSteps, outCount int) anyrnn.Block {
 				},
 			},
 		}
+	case "ridgesgdstore":
+		block := sgdstore.LinearBlock(c, 384, 16, 2, sgdSteps, 0.2, sgdstore.Tanh,
+			32, 256, 32)
+		block.SetRidge(c, 1)
+		return anyrnn.Stack{
+			normInputLayer(c, outCount, numPixels),
+			anyrnn.NewVanilla(c, numPixels+outCount, 384, anynet.Tanh),
+			anyrnn.NewVanilla(c, 384, 384, anynet.Tanh),
+			block,
+			&anyrnn.LayerBlock{
+				Layer: anynet.Net{
+					anynet.NewFC(c, 64, 64),
+					anynet.Tanh,
+					anynet.NewFC(c, 64, outCount),
+					anynet.LogSoftmax,
+				},
+			},
+		}
+	case "attnsgdstore":
+		// Attention over queries makes the block's output
+		// size independent of the query batch.
+		block := sgdstore.LinearBlock(c, 384, 16, 4, sgdSteps, 0.2, sgdstore.Tanh,
+			32, 256, 32)
+		block.SetAttention(c, 32)
+		return anyrnn.Stack{
+			normInputLayer(c, outCount, numPixels),
+			anyrnn.NewVanilla(c, numPixels+outCount, 384, anynet.Tanh),
+			anyrnn.NewVanilla(c, 384, 384, anynet.Tanh),
+			block,
+			&anyrnn.LayerBlock{
+				Layer: anynet.Net{
+					anynet.NewFC(c, 32, 64),
+					anynet.Tanh,
+					anynet.NewFC(c, 64, outCount),
+					anynet.LogSoftmax,
+				},
+			},
+		}
+	case "ctxsgdstore":
+		// The first timestep's features generate the
+		// initial memory for the episode.
+		block := sgdstore.LinearBlock(c, 384, 16, 2, sgdSteps, 0.2, sgdstore.Tanh,
+			32, 256, 32)
+		block.InitNet = initNet(c, block, 384, 32)
+		return anyrnn.Stack{
+			normInputLayer(c, outCount, numPixels),
+			anyrnn.NewVanilla(c, numPixels+outCount, 384, anynet.Tanh),
+			anyrnn.NewVanilla(c, 384, 384, anynet.Tanh),
+			&sgdstore.ContextBlock{Block: block},
+			&anyrnn.LayerBlock{
+				Layer: anynet.Net{
+					anynet.NewFC(c, 64, 64),
+					anynet.Tanh,
+					anynet.NewFC(c, 64, outCount),
+					anynet.LogSoftmax,
+				},
+			},
+		}
+	case "fastweights":
+		return anyrnn.Stack{
+			normInputLayer(c, outCount, numPixels),
+			anyrnn.NewVanilla(c, numPixels+outCount, 384, anynet.Tanh),
+			anyrnn.NewVanilla(c, 384, 384, anynet.Tanh),
+			sgdstore.NewFastWeightsBlock(c, 384, 16, 2, 0.2, 0.95, sgdstore.Tanh, 32, 32),
+			&anyrnn.LayerBlock{
+				Layer: anynet.Net{
+					anynet.NewFC(c, 64, 64),
+					anynet.Tanh,
+					anynet.NewFC(c, 64, outCount),
+					anynet.LogSoftmax,
+				},
+			},
+		}
+	case "convsgdstore":
+		convs := []*sgdstore.ConvLayer{
+			{
+				InWidth:      ImageSize,
+				InHeight:     ImageSize,
+				InDepth:      1,
+				FilterWidth:  4,
+				FilterHeight: 4,
+				Stride:       2,
+			},
+		}
+		return anyrnn.Stack{
+			normInputLayer(c, outCount, numPixels),
+			sgdstore.ConvBlock(c, numPixels+outCount, 16, 2, sgdSteps, 0.2,
+				sgdstore.Tanh, convs, []int{8}, 64, 32),
+			&anyrnn.LayerBlock{
+				Layer: anynet.Net{
+					anynet.NewFC(c, 64, 64),
+					anynet.Tanh,
+					anynet.NewFC(c, 64, outCount),
+					anynet.LogSoftmax,
+				},
+			},
+		}
 	case "parasgdstore":
 		return anyrnn.Stack{
 			normInputLayer(c, outCount, numPixels),
@@ -91,6 +188,24 @@ func CountParams(b anyrnn.Block) int {
 	return res
 }
 
+// initNet creates an InitNet for the block which maps
+// contexts through a small hidden layer.
+// Its output layer starts at zero, so the initial
+// parameters start out as the block's InitParams.
+func initNet(c anyvec.Creator, block *sgdstore.Block, ctxSize, hidden int) anynet.Net {
+	var numParams int
+	for _, p := range block.InitParams {
+		numParams += p.Vector.Len()
+	}
+	out := anynet.NewFC(c, hidden, numParams)
+	out.Weights.Vector.Scale(c.MakeNumeric(0))
+	return anynet.Net{
+		anynet.NewFC(c, ctxSize, hidden),
+		anynet.Tanh,
+		out,
+	}
+}
+
 func normInputLayer(c anyvec.Creator, numOut, numPixels int) anyrnn.Block {
 	affine := &anynet.Affine{
 		Scalers: anydiff.NewVar(c.MakeVector(numPixels + numOut)),
@@ -14,10 +14,12 @@ import (
 	"github.com/unixpickle/anynet/anys2s"
 	"github.com/unixpickle/anynet/anysgd"
 	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec32"
 	"github.com/unixpickle/essentials"
 	"github.com/unixpickle/omniglot"
 	"github.com/unixpickle/rip"
 	"github.com/unixpickle/serializer"
+	"github.com/unixpickle/sgdstore"
 )
 
 func Train(args []string) {
@@ -30,18 +32,35 @@ func Train(args []string) {
 	var batchSize int
 	var numClasses int
 	var episodeLen int
+	var lossPenalty float64
+	var maxSteps int
+	var haltThreshold float64
+	var ponderCost float64
+	var checkFinite bool
+	var rehearsal int
+	var evalSteps int
+	var evalStepScale float64
 
 	fs := flag.NewFlagSet("train", flag.ExitOnError)
 	fs.StringVar(&trainingPath, "training", "", "training data directory")
 	fs.StringVar(&testingPath, "testing", "", "testing data directory")
 	fs.StringVar(&modelPath, "out", "model_out", "model output path")
-	fs.StringVar(&modelType, "model", "sgdstore",
-		"model type (sgdstore, lstm, parasgdstore, or vanilla)")
+	fs.StringVar(&modelType, "model", "sgdstore", "model type (sgdstore, lstm, "+
+		"parasgdstore, ridgesgdstore, convsgdstore, attnsgdstore, ctxsgdstore, "+
+		"fastweights, or vanilla)")
 	fs.Float64Var(&stepSize, "step", 0.001, "SGD step size")
 	fs.IntVar(&sgdSteps, "steps", 1, "steps per sgdstore")
 	fs.IntVar(&batchSize, "batch", 16, "SGD batch size")
 	fs.IntVar(&numClasses, "classes", 5, "classes per episode")
 	fs.IntVar(&episodeLen, "eplen", 50, "episode length")
+	fs.Float64Var(&lossPenalty, "losspenalty", 0, "weight of sgdstore inner losses")
+	fs.IntVar(&maxSteps, "maxsteps", 0, "max adaptive steps per sgdstore (0 to disable)")
+	fs.Float64Var(&haltThreshold, "halt", 0.01, "initial inner loss halting threshold")
+	fs.Float64Var(&ponderCost, "pondercost", 0.001, "ponder cost for adaptive steps")
+	fs.IntVar(&rehearsal, "rehearsal", 0, "rehearsal buffer size per sgdstore")
+	fs.BoolVar(&checkFinite, "checkfinite", false, "stop if sgdstore produces NaN or Inf")
+	fs.IntVar(&evalSteps, "evalsteps", 0, "steps per sgdstore for validation (0 to keep)")
+	fs.Float64Var(&evalStepScale, "evalstepscale", 1, "sgdstore step size scale for validation")
 
 	fs.Parse(args)
 
@@ -51,14 +70,54 @@ func Train(args []string) {
 		essentials.Die("Required flags: -training and -testing. See -help.")
 	}
 
+	// Loaded models keep their saved settings unless a flag
+	// is passed explicitly.
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
 	var model anyrnn.Block
+	newModel := false
 	if err := serializer.LoadAny(modelPath, &model); err != nil {
 		log.Println("Creating new model.")
 		model = NewModel(modelType, sgdSteps, numClasses)
+		newModel = true
 	} else {
 		log.Println("Loaded model.")
 	}
 
+	for _, block := range sgdstore.FindBlocks(model) {
+		if !newModel && explicit["steps"] {
+			block.Steps = sgdSteps
+		}
+		if newModel || explicit["maxsteps"] {
+			if maxSteps == 0 {
+				block.MaxSteps = 0
+				block.HaltThreshold = nil
+			} else if block.HaltThreshold == nil {
+				err := block.SetAdaptive(anyvec32.CurrentCreator(), maxSteps, haltThreshold)
+				if err != nil {
+					essentials.Die(err)
+				}
+			} else {
+				block.MaxSteps = maxSteps
+			}
+		}
+		if newModel || explicit["rehearsal"] {
+			block.Rehearsal = rehearsal
+		}
+		// The trainer averages the cost over the batch.
+		if newModel || explicit["losspenalty"] {
+			block.LossPenalty = lossPenalty / float64(batchSize)
+		}
+		if newModel || explicit["pondercost"] {
+			block.PonderCost = ponderCost / float64(batchSize)
+		}
+		// CheckFinite is not saved with the model.
+		block.CheckFinite = checkFinite
+	}
+
 	training, err := omniglot.ReadSet(trainingPath)
 	if err != nil {
 		essentials.Die(err)
@@ -80,9 +139,10 @@ func Train(args []string) {
 	}
 	testSamples := *samples
 	testSamples.Sets = testing.ByClass()
+	finite := sgdstore.WatchFinite(model)
 	trainer := &anys2s.Trainer{
 		Func: func(s anyseq.Seq) anyseq.Seq {
-			return anyrnn.Map(s, model)
+			return anyrnn.Map(s, finite.RNN)
 		},
 		Params:  model.(anynet.Parameterizer).Parameters(),
 		Cost:    anynet.DotCost{},
@@ -98,12 +158,17 @@ func Train(args []string) {
 		Samples:     samples,
 		BatchSize:   batchSize,
 		StatusFunc: func(b anysgd.Batch) {
+			if err := finite.Err(); err != nil {
+				essentials.Die("not saving model:", err)
+			}
 			if iter%4 == 0 {
 				batch, err := trainer.Fetch(&testSamples)
 				if err != nil {
 					essentials.Die(err)
 				}
+				restore := sgdstore.OverrideSteps(model, evalSteps, evalStepScale)
 				cost := trainer.TotalCost(batch)
+				restore()
 				log.Printf("iter %d: cost=%v validation=%f", iter, trainer.LastCost,
 					anyvec.Sum(cost.Output()))
 			} else {
@@ -117,6 +182,9 @@ func Train(args []string) {
 		fmt.Fprintln(os.Stderr, err)
 	}
 
+	if err := finite.Err(); err != nil {
+		essentials.Die("not saving model:", err)
+	}
 	if err := serializer.SaveAny(modelPath, model); err != nil {
 		essentials.Die(err)
 	}
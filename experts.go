@@ -0,0 +1,164 @@
+package sgdstore
+
+import (
+	"math"
+	"sort"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
+)
+
+// An ExpertNet is a batch of mixture-of-experts storage
+// networks.
+//
+// Each of the Num mixtures contains NumExperts networks,
+// which are stored consecutively in Experts, so that
+// Experts.Num is Num*NumExperts.
+// A shared Router matrix maps each key (i.e. network
+// input) to a distribution over the experts, and the
+// output for a key is the weighted sum of the experts'
+// outputs.
+//
+// During training, each expert's gradient for an example
+// is scaled by the example's routing weight for the
+// expert, so that writes only affect the experts to which
+// they are routed.
+// The routing weights are multiplied by any existing
+// Experts.ExampleWeights.
+type ExpertNet struct {
+	Experts    *Net
+	Num        int
+	NumExperts int
+
+	// Router is a row-major matrix with one row per
+	// expert, which is multiplied by a key to produce
+	// routing logits.
+	Router anydiff.Res
+
+	// TopK, if non-zero, limits each key to the TopK
+	// experts with the largest routing weights.
+	// The weights are renormalized over these experts.
+	TopK int
+}
+
+// Apply applies the mixtures to a batch of input batches,
+// producing a batch of output batches.
+func (e *ExpertNet) Apply(inBatch anydiff.Res, batchSize int) anydiff.Res {
+	return anydiff.Pool(inBatch, func(inBatch anydiff.Res) anydiff.Res {
+		outs := e.Experts.Apply(batchedRepeat(inBatch, e.Num, e.NumExperts), batchSize)
+		rows := e.Num * e.NumExperts * batchSize
+		weighted := anydiff.ScaleRows(&anydiff.Matrix{
+			Data: outs,
+			Rows: rows,
+			Cols: outs.Output().Len() / rows,
+		}, e.Routes(inBatch, batchSize))
+		return batchedSumRows(&anydiff.MatrixBatch{
+			Data: weighted.Data,
+			Rows: e.NumExperts,
+			Cols: weighted.Data.Output().Len() / (e.Num * e.NumExperts),
+			Num:  e.Num,
+		})
+	})
+}
+
+// Train performs SGD training on the batch, using the
+// routing weights of the inputs as example weights for
+// the experts.
+//
+// There is one step size per mixture, which is shared by
+// all of its experts.
+//
+// The input, target, and stepSize needn't be pooled by
+// the caller.
+func (e *ExpertNet) Train(inBatch, target, stepSize anydiff.Res, batchSize,
+	numSteps int) *ExpertNet {
+	ins := anydiff.Fuse(inBatch, target, stepSize)
+	newParams := anydiff.PoolMulti(ins, func(s []anydiff.Res) anydiff.MultiRes {
+		inBatch, target, stepSize := s[0], s[1], s[2]
+		experts := *e.Experts
+		experts.ExampleWeights = e.Routes(inBatch, batchSize)
+		if e.Experts.ExampleWeights != nil {
+			experts.ExampleWeights = anydiff.Mul(experts.ExampleWeights,
+				e.Experts.ExampleWeights)
+		}
+		return experts.Train(
+			batchedRepeat(inBatch, e.Num, e.NumExperts),
+			batchedRepeat(target, e.Num, e.NumExperts),
+			batchedRepeat(stepSize, e.Num, e.NumExperts),
+			batchSize,
+			numSteps,
+		).Parameters
+	})
+	res := *e
+	res.Experts = e.Experts.withParameters(newParams)
+	return &res
+}
+
+// Routes computes the routing weights for a batch of
+// input batches.
+// The inputs are prepared (e.g. normalized) the same way
+// the experts prepare their keys.
+//
+// The result contains, for each mixture, a batch of
+// weights for each expert (i.e. it is ordered by mixture,
+// then expert, then example).
+func (e *ExpertNet) Routes(inBatch anydiff.Res, batchSize int) anydiff.Res {
+	keySize := e.Experts.InSize()
+	mixtures := *e.Experts
+	mixtures.Num = e.Num
+	inBatch = mixtures.prepareKeys(inBatch, batchSize)
+	logits := anydiff.MatMul(false, true,
+		&anydiff.Matrix{Data: inBatch, Rows: e.Num * batchSize, Cols: keySize},
+		&anydiff.Matrix{Data: e.Router, Rows: e.NumExperts, Cols: keySize},
+	).Data
+	if e.TopK != 0 && e.TopK < e.NumExperts {
+		logits = anydiff.Add(logits, anydiff.NewConst(e.topKMask(logits.Output())))
+	}
+	probs := anydiff.Exp(anydiff.LogSoftmax(logits, e.NumExperts))
+
+	// Transpose each mixture's batchSize x NumExperts matrix.
+	mixSize := batchSize * e.NumExperts
+	indices := make([]int, 0, e.Num*mixSize)
+	for mixture := 0; mixture < e.Num; mixture++ {
+		for expert := 0; expert < e.NumExperts; expert++ {
+			for example := 0; example < batchSize; example++ {
+				indices = append(indices, mixture*mixSize+example*e.NumExperts+expert)
+			}
+		}
+	}
+	c := probs.Output().Creator()
+	return newMapRes(probs, c.MakeMapper(e.Num*mixSize, indices), false)
+}
+
+// topKMask creates a vector which removes all but the
+// top e.TopK logits for each key when it is added to the
+// logits.
+func (e *ExpertNet) topKMask(logits anyvec.Vector) anyvec.Vector {
+	values := vecFloats(logits)
+	mask := make([]float64, len(values))
+	for i := 0; i < len(values); i += e.NumExperts {
+		row := values[i : i+e.NumExperts]
+		order := make([]int, len(row))
+		for j := range order {
+			order[j] = j
+		}
+		sort.SliceStable(order, func(j, k int) bool {
+			return row[order[j]] > row[order[k]]
+		})
+		for _, j := range order[e.TopK:] {
+			// Large enough that exp() underflows to zero.
+			mask[i+j] = -1e9
+		}
+	}
+	c := logits.Creator()
+	return c.MakeVectorData(c.MakeNumericList(mask))
+}
+
+// NewRouter creates a random routing matrix for an
+// ExpertNet.
+func NewRouter(c anyvec.Creator, numExperts, keySize int) *anydiff.Var {
+	res := anydiff.NewVar(c.MakeVector(numExperts * keySize))
+	anyvec.Rand(res.Vector, anyvec.Normal, nil)
+	res.Vector.Scale(c.MakeNumeric(1 / math.Sqrt(float64(keySize))))
+	return res
+}
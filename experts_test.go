@@ -0,0 +1,221 @@
+package sgdstore
+
+import (
+	"math"
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anydifftest"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestExpertNetRoutes(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	for _, topK := range []int{0, 1, 2} {
+		net, _ := randomExpertNet(c, 2, topK)
+		keys := c.MakeVector(net.Num * 5 * 3)
+		anyvec.Rand(keys, anyvec.Normal, nil)
+		routes := vecFloats(net.Routes(anydiff.NewConst(keys), 5).Output())
+		for i := 0; i < net.Num; i++ {
+			for j := 0; j < 5; j++ {
+				var sum float64
+				var nonZero int
+				for k := 0; k < net.NumExperts; k++ {
+					x := routes[(i*net.NumExperts+k)*5+j]
+					sum += x
+					if x > 1e-8 {
+						nonZero++
+					}
+				}
+				if math.Abs(sum-1) > 1e-4 {
+					t.Errorf("topK %d: weights sum to %f", topK, sum)
+				}
+				if topK != 0 && nonZero != topK {
+					t.Errorf("topK %d: got %d experts", topK, nonZero)
+				}
+			}
+		}
+	}
+}
+
+func TestExpertNetRoutesNormKeys(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	net, _ := randomExpertNet(c, 2, 0)
+	net.Experts.NormKeys = true
+	keys := c.MakeVector(net.Num * 5 * 3)
+	anyvec.Rand(keys, anyvec.Normal, nil)
+	scaled := keys.Copy()
+	scaled.Scale(c.MakeNumeric(3))
+
+	expected := net.Routes(anydiff.NewConst(keys), 5).Output()
+	actual := net.Routes(anydiff.NewConst(scaled), 5).Output()
+	diff := actual.Copy()
+	diff.Sub(expected)
+	if anyvec.AbsMax(diff).(float64) > 1e-4 {
+		t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+	}
+}
+
+func TestExpertNetTrain(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	for _, topK := range []int{0, 2} {
+		net, params := randomExpertNet(c, 2, topK)
+		input := anydiff.NewVar(c.MakeVector(net.Num * 4 * 3))
+		target := anydiff.NewVar(c.MakeVector(net.Num * 4 * 2))
+		stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1, 0.2}))
+		anyvec.Rand(input.Vector, anyvec.Normal, nil)
+		anyvec.Rand(target.Vector, anyvec.Normal, nil)
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				trained := net.Train(input, target, stepSize, 4, 2)
+				return trained.Apply(input, 4)
+			},
+			V: append([]*anydiff.Var{input, target, stepSize}, params...),
+		}
+		checker.FullCheck(t)
+	}
+}
+
+func TestExpertNetSparseWrite(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	net, params := randomExpertNet(c, 1, 1)
+
+	input := anydiff.NewVar(c.MakeVector(2 * 3))
+	target := anydiff.NewVar(c.MakeVector(2 * 2))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	routes := vecFloats(net.Routes(input, 2).Output())
+	trained := net.Train(input, target, anydiff.NewConst(c.MakeVectorData([]float64{0.1})),
+		2, 1)
+	for expert := 0; expert < net.NumExperts; expert++ {
+		routed := routes[expert*2] > 0 || routes[expert*2+1] > 0
+		for i, p := range trained.Experts.Parameters.Outputs() {
+			size := p.Len() / net.NumExperts
+			diff := p.Slice(expert*size, (expert+1)*size)
+			diff.Sub(params[i].Vector.Slice(expert*size, (expert+1)*size))
+			changed := anyvec.AbsMax(diff).(float64) > 0
+			if changed != routed {
+				t.Errorf("expert %d (routed=%v): changed=%v", expert, routed, changed)
+			}
+		}
+	}
+}
+
+func TestBlockExperts(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := LinearBlock(c, 3, 2, 2, 1, 0.1, Tanh, 4, 3, 2)
+	block.SetExperts(c, DefaultInit{}, 3, 2)
+	if block.InitParams[0].Vector.Len() != 3*4*3 {
+		t.Fatal("unexpected parameter size")
+	}
+	randomizeParams(block)
+
+	t.Run("Gradients", func(t *testing.T) {
+		checkBlockGradients(t, block)
+	})
+}
+
+// BenchmarkExpertCapacity measures how well a dense
+// network and a mixture of experts remember a sequence of
+// writes, reporting the mean squared recall error.
+func BenchmarkExpertCapacity(b *testing.B) {
+	b.Run("Dense", func(b *testing.B) {
+		benchmarkCapacity(b, 0, 0, 32)
+	})
+	b.Run("DenseWide", func(b *testing.B) {
+		// Same number of parameters as Experts.
+		benchmarkCapacity(b, 0, 0, 32*4)
+	})
+	b.Run("Experts", func(b *testing.B) {
+		benchmarkCapacity(b, 4, 1, 32)
+	})
+}
+
+func benchmarkCapacity(b *testing.B, numExperts, topK, hidden int) {
+	const (
+		keySize    = 8
+		valueSize  = 4
+		numPairs   = 64
+		writeBatch = 4
+	)
+	c := anyvec64.CurrentCreator()
+	var totalErr float64
+	for i := 0; i < b.N; i++ {
+		keys := c.MakeVector(numPairs * keySize)
+		values := c.MakeVector(numPairs * valueSize)
+		anyvec.Rand(keys, anyvec.Normal, nil)
+		anyvec.Rand(values, anyvec.Uniform, nil)
+
+		num := 1
+		if numExperts != 0 {
+			num = numExperts
+		}
+		var params []anydiff.Res
+		for _, p := range NewStorageParams(c, DefaultInit{}, keySize, hidden, valueSize) {
+			var reps []anyvec.Vector
+			for j := 0; j < num; j++ {
+				reps = append(reps, p.Vector)
+			}
+			params = append(params, anydiff.NewConst(c.Concat(reps...)))
+		}
+		net := &Net{Parameters: anydiff.Fuse(params...), Num: num, Activation: Tanh}
+		experts := &ExpertNet{
+			Experts:    net,
+			Num:        1,
+			NumExperts: numExperts,
+			Router:     NewRouter(c, numExperts, keySize),
+			TopK:       topK,
+		}
+
+		stepSize := anydiff.NewConst(c.MakeVectorData([]float64{0.5}))
+		for j := 0; j < numPairs; j += writeBatch {
+			in := anydiff.NewConst(keys.Slice(j*keySize, (j+writeBatch)*keySize))
+			target := anydiff.NewConst(values.Slice(j*valueSize, (j+writeBatch)*valueSize))
+			if numExperts == 0 {
+				net = net.Train(in, target, stepSize, writeBatch, 1)
+			} else {
+				experts = experts.Train(in, target, stepSize, writeBatch, 1)
+			}
+		}
+
+		var out anydiff.Res
+		if numExperts == 0 {
+			out = net.Apply(anydiff.NewConst(keys), numPairs)
+		} else {
+			out = experts.Apply(anydiff.NewConst(keys), numPairs)
+		}
+		diff := out.Output().Copy()
+		diff.Sub(values)
+		for _, x := range vecFloats(diff) {
+			totalErr += x * x / float64(diff.Len())
+		}
+	}
+	b.ReportMetric(totalErr/float64(b.N), "mse")
+}
+
+func randomExpertNet(c anyvec.Creator, num, topK int) (*ExpertNet, []*anydiff.Var) {
+	const numExperts = 3
+	var vars []*anydiff.Var
+	var reses []anydiff.Res
+	for _, size := range []int{3 * 4, 4, 4 * 2, 2} {
+		v := anydiff.NewVar(c.MakeVector(num * numExperts * size))
+		anyvec.Rand(v.Vector, anyvec.Normal, nil)
+		vars = append(vars, v)
+		reses = append(reses, v)
+	}
+	router := NewRouter(c, numExperts, 3)
+	net := &ExpertNet{
+		Experts: &Net{
+			Parameters: anydiff.Fuse(reses...),
+			Num:        num * numExperts,
+			Activation: Tanh,
+		},
+		Num:        num,
+		NumExperts: numExperts,
+		Router:     router,
+		TopK:       topK,
+	}
+	return net, append(vars, router)
+}
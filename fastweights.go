@@ -0,0 +1,257 @@
+package sgdstore
+
+import (
+	"errors"
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvecsave"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer((&FastWeightsBlock{}).SerializerType(),
+		DeserializeFastWeightsBlock)
+}
+
+// FastWeightsBlock is an RNN block that uses a matrix of
+// fast weights as its memory, updated with a Hebbian
+// outer-product rule.
+//
+// It uses the same gates as a Block, making it a baseline
+// for comparison.
+// At each timestep, the memory is updated as
+//
+//     W = Decay*W + step*sum(value*key^T)
+//
+// where the keys come from TrainInput, the values come
+// from TrainTarget, and the sum is over the training
+// batch.
+// Each query q then produces the output Activation(W*q).
+type FastWeightsBlock struct {
+	// InitWeights is the initial weight matrix, stored in
+	// row-major order with one row per value component.
+	InitWeights *anydiff.Var
+
+	// KeySize is the number of columns in the matrix.
+	KeySize int
+
+	Activation Activation
+
+	TrainInput  anynet.Layer
+	TrainTarget anynet.Layer
+	StepSize    anynet.Layer
+	Query       anynet.Layer
+
+	// Decay scales the weights before every update.
+	Decay float64
+}
+
+// NewFastWeightsBlock creates a FastWeightsBlock with
+// linear gates and zero initial weights.
+//
+// The arguments are analogous to those of LinearBlock.
+// The block's output size is queryBatch*valueSize.
+func NewFastWeightsBlock(c anyvec.Creator, blockIn, trainBatch, queryBatch int,
+	lrBias, decay float64, activation Activation, keySize,
+	valueSize int) *FastWeightsBlock {
+	if trainBatch < 1 || queryBatch < 1 {
+		panic("invalid batch size")
+	}
+	return &FastWeightsBlock{
+		InitWeights: anydiff.NewVar(c.MakeVector(keySize * valueSize)),
+		KeySize:     keySize,
+		Activation:  activation,
+		TrainInput:  anynet.NewFC(c, blockIn, trainBatch*keySize),
+		TrainTarget: anynet.Net{
+			anynet.NewFC(c, blockIn, trainBatch*valueSize),
+			activation.Layer(),
+		},
+		StepSize: anynet.Net{
+			anynet.NewFC(c, blockIn, 1).AddBias(c.MakeNumeric(math.Log(lrBias))),
+			anynet.Exp,
+		},
+		Query: anynet.NewFC(c, blockIn, queryBatch*keySize),
+		Decay: decay,
+	}
+}
+
+// DeserializeFastWeightsBlock deserializes a
+// FastWeightsBlock.
+func DeserializeFastWeightsBlock(d []byte) (block *FastWeightsBlock, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.FastWeightsBlock", &err)
+	var weights *anyvecsave.S
+	var optData []byte
+	block = &FastWeightsBlock{}
+	err = serializer.DeserializeAny(d, &weights, &block.KeySize, &block.TrainInput,
+		&block.TrainTarget, &block.StepSize, &block.Query, &optData)
+	if err != nil {
+		return nil, err
+	}
+	block.InitWeights = anydiff.NewVar(weights.Vector)
+	if err := deserializeOptions(optData, block.setOption); err != nil {
+		return nil, err
+	}
+	return block, nil
+}
+
+// Start produces a start state.
+func (f *FastWeightsBlock) Start(n int) anyrnn.State {
+	return &State{
+		Params: []*anyrnn.VecState{anyrnn.NewVecState(f.InitWeights.Vector, n)},
+	}
+}
+
+// PropagateStart propagates through the start state.
+func (f *FastWeightsBlock) PropagateStart(s anyrnn.StateGrad, g anydiff.Grad) {
+	s.(*State).Params[0].PropagateStart(f.InitWeights, g)
+}
+
+// Step evaluates the block.
+func (f *FastWeightsBlock) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
+	state := s.(*State)
+	inPool := anydiff.NewVar(in)
+	statePool := state.pool()
+	present := state.Present()
+	n := present.NumPresent()
+
+	var gateOuts []anydiff.Res
+	for _, gate := range []anynet.Layer{f.TrainInput, f.TrainTarget, f.StepSize, f.Query} {
+		gateOuts = append(gateOuts, gate.Apply(inPool, n))
+	}
+	allRes := anydiff.PoolMulti(anydiff.Fuse(gateOuts...),
+		func(gateOuts []anydiff.Res) anydiff.MultiRes {
+			return f.readWrite(statePool[0], gateOuts, n)
+		})
+
+	newState := &State{
+		Params: []*anyrnn.VecState{{
+			PresentMap: present,
+			Vector:     allRes.Outputs()[1],
+		}},
+		Timestep: state.Timestep + 1,
+	}
+	return &blockRes{
+		InPool:     inPool,
+		StatePools: statePool,
+		OutVec:     allRes.Outputs()[0],
+		OutState:   newState,
+		AllRes:     allRes,
+		V:          anydiff.NewVarSet(f.Parameters()...),
+	}
+}
+
+// Parameters returns the block's parameters, including
+// the parameters of the gates.
+func (f *FastWeightsBlock) Parameters() []*anydiff.Var {
+	gateParams := anynet.AllParameters(f.TrainInput, f.TrainTarget, f.StepSize, f.Query)
+	return append(gateParams, f.InitWeights)
+}
+
+// SerializerType returns the unique ID used to serialize
+// a FastWeightsBlock with the serializer package.
+func (f *FastWeightsBlock) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.FastWeightsBlock"
+}
+
+// Serialize serializes the block.
+//
+// Like a Block, the optional fields are saved as named
+// options.
+func (f *FastWeightsBlock) Serialize() ([]byte, error) {
+	optData, err := serializeOptions(f.options())
+	if err != nil {
+		return nil, err
+	}
+	return serializer.SerializeAny(
+		&anyvecsave.S{Vector: f.InitWeights.Vector},
+		f.KeySize,
+		f.TrainInput,
+		f.TrainTarget,
+		f.StepSize,
+		f.Query,
+		serializer.Bytes(optData),
+	)
+}
+
+// options lists the optional fields which differ from
+// their zero values, using the same names as
+// Block.options.
+func (f *FastWeightsBlock) options() []blockOption {
+	var res []blockOption
+	if f.Activation != Tanh {
+		res = append(res, blockOption{"activation", []interface{}{int(f.Activation)}})
+	}
+	if f.Decay != 0 {
+		res = append(res, blockOption{"decay", []interface{}{f.Decay}})
+	}
+	return res
+}
+
+// setOption decodes an option produced by options.
+func (f *FastWeightsBlock) setOption(name string, data []byte) error {
+	switch name {
+	case "activation":
+		var act int
+		err := serializer.DeserializeAny(data, &act)
+		f.Activation = Activation(act)
+		return err
+	case "decay":
+		return serializer.DeserializeAny(data, &f.Decay)
+	default:
+		return errors.New("unknown option")
+	}
+}
+
+// readWrite updates the weights and queries them.
+// The result is [output, newWeights].
+// The caller should pool the weights and gate outputs.
+func (f *FastWeightsBlock) readWrite(weights anydiff.Res, gateOuts []anydiff.Res,
+	n int) anydiff.MultiRes {
+	keys, values, stepSize, query := gateOuts[0], gateOuts[1], gateOuts[2], gateOuts[3]
+	if stepSize.Output().Len() != n {
+		panic("invalid stepSize length")
+	}
+	c := keys.Output().Creator()
+	valueSize := f.InitWeights.Vector.Len() / f.KeySize
+	trainBatch := keys.Output().Len() / (f.KeySize * n)
+	queryBatch := query.Output().Len() / (f.KeySize * n)
+
+	keyMat := &anydiff.MatrixBatch{Data: keys, Rows: trainBatch, Cols: f.KeySize, Num: n}
+	valueMat := &anydiff.MatrixBatch{
+		Data: values,
+		Rows: trainBatch,
+		Cols: valueSize,
+		Num:  n,
+	}
+	update := &anydiff.Matrix{
+		Data: anydiff.BatchedMatMul(true, false, valueMat, keyMat).Data,
+		Rows: n,
+		Cols: valueSize * f.KeySize,
+	}
+	newWeights := anydiff.Add(
+		anydiff.Scale(weights, c.MakeNumeric(f.Decay)),
+		anydiff.ScaleRows(update, stepSize).Data,
+	)
+
+	return anydiff.PoolFork(newWeights, func(newWeights anydiff.Res) anydiff.MultiRes {
+		weightMat := &anydiff.MatrixBatch{
+			Data: newWeights,
+			Rows: valueSize,
+			Cols: f.KeySize,
+			Num:  n,
+		}
+		queryMat := &anydiff.MatrixBatch{
+			Data: query,
+			Rows: queryBatch,
+			Cols: f.KeySize,
+			Num:  n,
+		}
+		out := anydiff.BatchedMatMul(false, true, queryMat, weightMat).Data
+		return anydiff.Fuse(f.Activation.Forward(out), newWeights)
+	})
+}
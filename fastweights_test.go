@@ -0,0 +1,54 @@
+package sgdstore
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff/anydifftest"
+	"github.com/unixpickle/anydiff/anyseq"
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+	"github.com/unixpickle/serializer"
+)
+
+func TestFastWeightsGradients(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := NewFastWeightsBlock(c, 3, 2, 2, 0.1, 0.9, Tanh, 4, 2)
+	randomizeParams(block)
+	inSeq, inVars := randomTestSequence(3)
+	checker := &anydifftest.SeqChecker{
+		F: func() anyseq.Seq {
+			return anyrnn.Map(inSeq, block)
+		},
+		V: append(inVars, block.Parameters()...),
+	}
+	checker.FullCheck(t)
+}
+
+func TestFastWeightsSerialize(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	block := NewFastWeightsBlock(c, 3, 2, 2, 0.1, 0.9, ReLU, 4, 2)
+	randomizeParams(block)
+
+	data, err := serializer.SerializeAny(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var decoded *FastWeightsBlock
+	if err := serializer.DeserializeAny(data, &decoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.KeySize != block.KeySize || decoded.Decay != block.Decay ||
+		decoded.Activation != block.Activation {
+		t.Fatal("settings not preserved")
+	}
+
+	in := c.MakeVectorData([]float64{0.3, 0.5, -0.3})
+	expected := block.Step(block.Start(1), in).Output()
+	actual := decoded.Step(decoded.Start(1), in).Output()
+	diff := actual.Copy()
+	diff.Sub(expected)
+	if anyvec.AbsMax(diff).(float64) > 1e-4 {
+		t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+	}
+}
@@ -0,0 +1,178 @@
+package sgdstore
+
+import (
+	"fmt"
+	"math"
+	"sync"
+
+	"github.com/unixpickle/anynet/anyrnn"
+	"github.com/unixpickle/anyvec"
+)
+
+// NonFiniteError describes a NaN or infinity found by a
+// Block with CheckFinite enabled.
+type NonFiniteError struct {
+	// Sequence is the index of the sequence in the batch.
+	Sequence int
+
+	// Timestep is the index of the timestep within the
+	// sequence.
+	Timestep int
+
+	// InnerStep is the index of the SGD step at which the
+	// value was produced, or -1 if the value does not come
+	// from an SGD step.
+	InnerStep int
+
+	// Layer is the index of the storage network's layer,
+	// or -1 if the value does not belong to a layer.
+	Layer int
+
+	// Value describes the value, such as "step size" or
+	// "weight gradient".
+	Value string
+}
+
+// Error returns a descriptive error message.
+func (n *NonFiniteError) Error() string {
+	msg := fmt.Sprintf("non-finite %s in sequence %d at timestep %d", n.Value,
+		n.Sequence, n.Timestep)
+	if n.InnerStep >= 0 {
+		msg += fmt.Sprintf(", inner step %d", n.InnerStep)
+	}
+	if n.Layer >= 0 {
+		msg += fmt.Sprintf(", layer %d", n.Layer)
+	}
+	return msg
+}
+
+// A FiniteWatcher records the first NonFiniteError found
+// while evaluating an RNN.
+//
+// Errors are read from the States produced by the
+// Blocks, DualBlocks, and ContextBlocks in the RNN, so
+// the watcher only reports problems from its own RNN,
+// and only since the last call to Reset.
+type FiniteWatcher struct {
+	// RNN is a copy of the watched RNN which records
+	// errors when it is evaluated.
+	// It shares its blocks and parameters with the
+	// original RNN.
+	RNN anyrnn.Block
+
+	lock sync.Mutex
+	err  *NonFiniteError
+}
+
+// WatchFinite creates a FiniteWatcher for an RNN.
+// The RNN's Blocks should have CheckFinite enabled.
+func WatchFinite(root anyrnn.Block) *FiniteWatcher {
+	w := &FiniteWatcher{}
+	w.RNN = MapBlocks(root, func(b anyrnn.Block) anyrnn.Block {
+		switch b.(type) {
+		case *Block, *DualBlock, *ContextBlock:
+			return &watchedBlock{Block: b, Watcher: w}
+		}
+		return b
+	})
+	return w
+}
+
+// Err returns the first error recorded since the last
+// call to Reset, or nil if there was none.
+func (f *FiniteWatcher) Err() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	if f.err == nil {
+		return nil
+	}
+	return f.err
+}
+
+// Reset clears the recorded error.
+func (f *FiniteWatcher) Reset() {
+	f.lock.Lock()
+	f.err = nil
+	f.lock.Unlock()
+}
+
+func (f *FiniteWatcher) record(err *NonFiniteError) {
+	if err == nil {
+		return
+	}
+	f.lock.Lock()
+	if f.err == nil {
+		f.err = err
+	}
+	f.lock.Unlock()
+}
+
+// watchedBlock reports the errors in the States of a
+// Block, DualBlock, or ContextBlock to a FiniteWatcher.
+type watchedBlock struct {
+	anyrnn.Block
+	Watcher *FiniteWatcher
+}
+
+func (w *watchedBlock) Step(s anyrnn.State, in anyvec.Vector) anyrnn.Res {
+	res := w.Block.Step(s, in)
+	switch state := res.State().(type) {
+	case *State:
+		w.Watcher.record(state.FiniteErr)
+	case *DualState:
+		w.Watcher.record(state.Fast.FiniteErr)
+	}
+	return res
+}
+
+// finiteChecker looks for non-finite values while a Block
+// takes a single timestep.
+type finiteChecker struct {
+	// Sequences maps network indices to sequence indices.
+	Sequences []int
+	Timestep  int
+
+	// Step is the index of the next SGD step.
+	Step int
+
+	// Prefix is prepended to every value description.
+	Prefix string
+
+	// Err is the first error, or nil.
+	Err *NonFiniteError
+}
+
+// CheckVec checks a vector containing a chunk for each
+// network.
+func (f *finiteChecker) CheckVec(vec anyvec.Vector, value string, innerStep,
+	layer int) {
+	if f.Err != nil {
+		return
+	}
+	values := vecFloats(vec)
+	chunkSize := len(values) / len(f.Sequences)
+	for i, x := range values {
+		if math.IsNaN(x) || math.IsInf(x, 0) {
+			f.Err = &NonFiniteError{
+				Sequence:  f.Sequences[i/chunkSize],
+				Timestep:  f.Timestep,
+				InnerStep: innerStep,
+				Layer:     layer,
+				Value:     f.Prefix + value,
+			}
+			return
+		}
+	}
+}
+
+// CheckParams checks a list of per-layer weights and
+// biases (or their gradients), as produced by an SGD step.
+func (f *finiteChecker) CheckParams(params []anyvec.Vector, suffix string) {
+	for i, p := range params {
+		name := "weight"
+		if i%2 == 1 {
+			name = "bias"
+		}
+		f.CheckVec(p, name+suffix, f.Step, i/2)
+	}
+}
@@ -0,0 +1,271 @@
+package sgdstore
+
+import (
+	"math"
+	"math/rand"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anyvec"
+)
+
+// An Initializer creates the initial parameters for a
+// layer of a storage network.
+type Initializer interface {
+	// InitLayer creates a row-major weight matrix and a
+	// bias vector.
+	// The last argument indicates whether or not the layer
+	// is the final layer of the network.
+	InitLayer(c anyvec.Creator, inSize, outSize int, last bool) (weights,
+		biases anyvec.Vector)
+}
+
+// DefaultInit is an Initializer which uses the same
+// initialization as anynet.NewFC.
+type DefaultInit struct{}
+
+// InitLayer initializes a layer.
+func (d DefaultInit) InitLayer(c anyvec.Creator, inSize, outSize int,
+	last bool) (weights, biases anyvec.Vector) {
+	fc := anynet.NewFC(c, inSize, outSize)
+	return fc.Weights.Vector, fc.Biases.Vector
+}
+
+// XavierInit is an Initializer which uses the uniform
+// Xavier (Glorot) initialization for weights and zero
+// biases.
+type XavierInit struct {
+	// Rand, if non-nil, is the source of randomness.
+	// If it is nil, the math/rand package is used.
+	Rand *rand.Rand
+}
+
+// InitLayer initializes a layer.
+func (x XavierInit) InitLayer(c anyvec.Creator, inSize, outSize int,
+	last bool) (weights, biases anyvec.Vector) {
+	bound := math.Sqrt(6 / float64(inSize+outSize))
+	data := make([]float64, inSize*outSize)
+	for i := range data {
+		data[i] = bound * (randFloat(x.Rand)*2 - 1)
+	}
+	return c.MakeVectorData(c.MakeNumericList(data)), c.MakeVector(outSize)
+}
+
+// OrthogonalInit is an Initializer which creates random
+// weight matrices with orthonormal rows (or columns, if
+// there are more rows than columns), scaled by Gain.
+// Biases are zero.
+//
+// A Gain of 0 is treated as 1.
+type OrthogonalInit struct {
+	Gain float64
+
+	// Rand, if non-nil, is the source of randomness.
+	// If it is nil, the math/rand package is used.
+	Rand *rand.Rand
+}
+
+// InitLayer initializes a layer.
+func (o OrthogonalInit) InitLayer(c anyvec.Creator, inSize, outSize int,
+	last bool) (weights, biases anyvec.Vector) {
+	gain := o.Gain
+	if gain == 0 {
+		gain = 1
+	}
+	rows, cols := outSize, inSize
+	if rows > cols {
+		rows, cols = cols, rows
+	}
+	vecs := make([][]float64, rows)
+	for i := range vecs {
+		vecs[i] = make([]float64, cols)
+		for j := range vecs[i] {
+			vecs[i][j] = randNorm(o.Rand)
+		}
+		// Gram-Schmidt with a retry for degenerate vectors.
+		for {
+			for _, prev := range vecs[:i] {
+				dot := dotFloats(prev, vecs[i])
+				for j, x := range prev {
+					vecs[i][j] -= dot * x
+				}
+			}
+			norm := math.Sqrt(dotFloats(vecs[i], vecs[i]))
+			if norm > 1e-8 {
+				for j := range vecs[i] {
+					vecs[i][j] *= gain / norm
+				}
+				break
+			}
+			for j := range vecs[i] {
+				vecs[i][j] = randNorm(o.Rand)
+			}
+		}
+	}
+	data := make([]float64, 0, inSize*outSize)
+	if outSize <= inSize {
+		for _, vec := range vecs {
+			data = append(data, vec...)
+		}
+	} else {
+		for row := 0; row < outSize; row++ {
+			for col := 0; col < inSize; col++ {
+				data = append(data, vecs[col][row])
+			}
+		}
+	}
+	return c.MakeVectorData(c.MakeNumericList(data)), c.MakeVector(outSize)
+}
+
+// NormalInit is an Initializer which samples weights
+// from a normal distribution with standard deviation
+// Scale/sqrt(inSize).
+// Biases are zero.
+type NormalInit struct {
+	Scale float64
+
+	// Rand, if non-nil, is the source of randomness.
+	// If it is nil, the math/rand package is used.
+	Rand *rand.Rand
+}
+
+// InitLayer initializes a layer.
+func (n NormalInit) InitLayer(c anyvec.Creator, inSize, outSize int,
+	last bool) (weights, biases anyvec.Vector) {
+	stddev := n.Scale / math.Sqrt(float64(inSize))
+	data := make([]float64, inSize*outSize)
+	for i := range data {
+		data[i] = randNorm(n.Rand) * stddev
+	}
+	return c.MakeVectorData(c.MakeNumericList(data)), c.MakeVector(outSize)
+}
+
+// ZeroOutputInit is an Initializer which sets the final
+// layer's weights and biases to zero, so that the initial
+// network outputs a constant.
+// Other layers are initialized with Hidden, or with
+// DefaultInit if Hidden is nil.
+type ZeroOutputInit struct {
+	Hidden Initializer
+}
+
+// InitLayer initializes a layer.
+func (z ZeroOutputInit) InitLayer(c anyvec.Creator, inSize, outSize int,
+	last bool) (weights, biases anyvec.Vector) {
+	if last {
+		return c.MakeVector(inSize * outSize), c.MakeVector(outSize)
+	}
+	hidden := z.Hidden
+	if hidden == nil {
+		hidden = DefaultInit{}
+	}
+	return hidden.InitLayer(c, inSize, outSize, last)
+}
+
+// NewStorageParams creates initial parameters for a
+// storage network, suitable for Block.InitParams.
+//
+// The layer sizes are interpreted like they are for
+// LinearBlock.
+func NewStorageParams(c anyvec.Creator, init Initializer,
+	layerSizes ...int) []*anydiff.Var {
+	if len(layerSizes) < 2 {
+		panic("not enough layer sizes")
+	}
+	var res []*anydiff.Var
+	for i := 1; i < len(layerSizes); i++ {
+		last := i+1 == len(layerSizes)
+		weights, biases := init.InitLayer(c, layerSizes[i-1], layerSizes[i], last)
+		res = append(res, anydiff.NewVar(weights), anydiff.NewVar(biases))
+	}
+	return res
+}
+
+// DataInit adjusts the initial parameters of the storage
+// network so that, for a sample batch of inputs (keys),
+// every layer's pre-activations have zero mean and unit
+// variance.
+// Units with no variance are left unchanged.
+//
+// The keys should contain at least two inputs.
+// Convolutional storage networks, embedding tables,
+// experts, and ensembles are not supported.
+func (b *Block) DataInit(keys anyvec.Vector) {
+	if b.Conv != nil || b.Embedding || b.Experts != 0 || b.Ensemble != 0 {
+		panic("data-dependent initialization requires a single fully-connected network")
+	}
+	DataInit(b.InitParams, b.Activation, keys)
+}
+
+// DataInit performs data-dependent initialization on a
+// list of storage network parameters.
+// See Block.DataInit.
+func DataInit(params []*anydiff.Var, act Activation, keys anyvec.Vector) {
+	c := keys.Creator()
+	in := vecFloats(keys)
+	for l := 0; l < len(params); l += 2 {
+		weights := append([]float64{}, vecFloats(params[l].Vector)...)
+		biases := append([]float64{}, vecFloats(params[l+1].Vector)...)
+		outSize := len(biases)
+		inSize := len(weights) / outSize
+		batch := len(in) / inSize
+
+		pre := make([]float64, batch*outSize)
+		for i := 0; i < batch; i++ {
+			for j := 0; j < outSize; j++ {
+				row := weights[j*inSize : (j+1)*inSize]
+				pre[i*outSize+j] = dotFloats(row, in[i*inSize:(i+1)*inSize]) + biases[j]
+			}
+		}
+
+		for j := 0; j < outSize; j++ {
+			var mean, sqMean float64
+			for i := 0; i < batch; i++ {
+				x := pre[i*outSize+j]
+				mean += x / float64(batch)
+				sqMean += x * x / float64(batch)
+			}
+			stddev := math.Sqrt(math.Max(0, sqMean-mean*mean))
+			if stddev < 1e-8 {
+				continue
+			}
+			for k := 0; k < inSize; k++ {
+				weights[j*inSize+k] /= stddev
+			}
+			biases[j] = (biases[j] - mean) / stddev
+			for i := 0; i < batch; i++ {
+				pre[i*outSize+j] = (pre[i*outSize+j] - mean) / stddev
+			}
+		}
+
+		params[l].Vector.SetData(c.MakeNumericList(weights))
+		params[l+1].Vector.SetData(c.MakeNumericList(biases))
+
+		in = make([]float64, len(pre))
+		for i, x := range pre {
+			in[i] = act.apply(x)
+		}
+	}
+}
+
+func dotFloats(v1, v2 []float64) float64 {
+	var res float64
+	for i, x := range v1 {
+		res += x * v2[i]
+	}
+	return res
+}
+
+func randFloat(r *rand.Rand) float64 {
+	if r != nil {
+		return r.Float64()
+	}
+	return rand.Float64()
+}
+
+func randNorm(r *rand.Rand) float64 {
+	if r != nil {
+		return r.NormFloat64()
+	}
+	return rand.NormFloat64()
+}
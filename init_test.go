@@ -0,0 +1,116 @@
+package sgdstore
+
+import (
+	"math"
+	"math/rand"
+	"testing"
+
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestOrthogonalInit(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	for _, shape := range [][2]int{{5, 3}, {3, 5}, {4, 4}} {
+		inSize, outSize := shape[0], shape[1]
+		weights, _ := OrthogonalInit{Gain: 2}.InitLayer(c, inSize, outSize, false)
+		data := vecFloats(weights)
+
+		// Compute dot products between the rows (or columns).
+		num, size := outSize, inSize
+		get := func(i, j int) float64 {
+			return data[i*inSize+j]
+		}
+		if outSize > inSize {
+			num, size = inSize, outSize
+			get = func(i, j int) float64 {
+				return data[j*inSize+i]
+			}
+		}
+		for i := 0; i < num; i++ {
+			for j := 0; j < num; j++ {
+				var dot float64
+				for k := 0; k < size; k++ {
+					dot += get(i, k) * get(j, k)
+				}
+				expected := 0.0
+				if i == j {
+					expected = 4
+				}
+				if math.Abs(dot-expected) > 1e-4 {
+					t.Errorf("shape %v: dot(%d, %d) should be %f but got %f", shape, i, j,
+						expected, dot)
+				}
+			}
+		}
+	}
+}
+
+func TestInitRand(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	inits := map[string]func(r *rand.Rand) Initializer{
+		"Xavier": func(r *rand.Rand) Initializer {
+			return XavierInit{Rand: r}
+		},
+		"Orthogonal": func(r *rand.Rand) Initializer {
+			return OrthogonalInit{Rand: r}
+		},
+		"Normal": func(r *rand.Rand) Initializer {
+			return NormalInit{Scale: 1, Rand: r}
+		},
+	}
+	for name, makeInit := range inits {
+		w1, _ := makeInit(rand.New(rand.NewSource(1337))).InitLayer(c, 4, 3, false)
+		w2, _ := makeInit(rand.New(rand.NewSource(1337))).InitLayer(c, 4, 3, false)
+		w3, _ := makeInit(rand.New(rand.NewSource(42))).InitLayer(c, 4, 3, false)
+		diff := w1.Copy()
+		diff.Sub(w2)
+		if anyvec.AbsMax(diff).(float64) != 0 {
+			t.Errorf("%s: same seed gave %v and %v", name, w1.Data(), w2.Data())
+		}
+		diff = w1.Copy()
+		diff.Sub(w3)
+		if anyvec.AbsMax(diff).(float64) == 0 {
+			t.Errorf("%s: different seeds gave the same weights", name)
+		}
+	}
+}
+
+func TestZeroOutputInit(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	params := NewStorageParams(c, ZeroOutputInit{Hidden: XavierInit{}}, 4, 5, 2)
+	if len(params) != 4 {
+		t.Fatalf("expected 4 parameters but got %d", len(params))
+	}
+	if anyvec.AbsMax(params[0].Vector).(float64) == 0 {
+		t.Error("hidden weights should not be zero")
+	}
+	for _, p := range params[2:] {
+		if anyvec.AbsMax(p.Vector).(float64) != 0 {
+			t.Error("output layer should be zero")
+		}
+	}
+}
+
+func TestDataInit(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	params := NewStorageParams(c, DefaultInit{}, 3, 4, 2)
+	keys := c.MakeVector(3 * 10)
+	anyvec.Rand(keys, anyvec.Normal, nil)
+	keys.AddScalar(c.MakeNumeric(2))
+	DataInit(params, Tanh, keys)
+
+	weights, biases := vecFloats(params[0].Vector), vecFloats(params[1].Vector)
+	in := vecFloats(keys)
+	for j := 0; j < 4; j++ {
+		var mean, sqMean float64
+		for i := 0; i < 10; i++ {
+			x := dotFloats(weights[j*3:(j+1)*3], in[i*3:(i+1)*3]) + biases[j]
+			mean += x / 10
+			sqMean += x * x / 10
+		}
+		if math.Abs(mean) > 1e-4 || math.Abs(sqMean-1) > 1e-4 {
+			t.Errorf("unit %d: mean %f, second moment %f", j, mean, sqMean)
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package sgdstore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anynet"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvecsave"
+	"github.com/unixpickle/essentials"
+	"github.com/unixpickle/serializer"
+)
+
+func init() {
+	serializer.RegisterTypedDeserializer((&Channel{}).SerializerType(), DeserializeChannel)
+	serializer.RegisterTypedDeserializer((&ScaledSigmoid{}).SerializerType(),
+		DeserializeScaledSigmoid)
+	serializer.RegisterTypedDeserializer((&TiedFC{}).SerializerType(), DeserializeTiedFC)
+	serializer.RegisterTypedDeserializer((&Softmax{}).SerializerType(), DeserializeSoftmax)
+}
+
+// Channel is an anynet.Layer which selects a single
+// component from each input vector.
+//
+// A Channel can be used as a Block's Reset gate, in which
+// case the memory is reset whenever the selected input
+// component is 1.
+type Channel struct {
+	Index int
+}
+
+// DeserializeChannel deserializes a Channel.
+func DeserializeChannel(d []byte) (channel *Channel, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.Channel", &err)
+	channel = &Channel{}
+	if err := serializer.DeserializeAny(d, &channel.Index); err != nil {
+		return nil, err
+	}
+	return channel, nil
+}
+
+// Apply selects the channel from each input in the batch.
+func (c *Channel) Apply(in anydiff.Res, n int) anydiff.Res {
+	inSize := in.Output().Len() / n
+	if c.Index < 0 || c.Index >= inSize {
+		panic("channel index out of bounds")
+	}
+	return anydiff.Pool(in, func(in anydiff.Res) anydiff.Res {
+		var res []anydiff.Res
+		for i := 0; i < n; i++ {
+			idx := i*inSize + c.Index
+			res = append(res, anydiff.Slice(in, idx, idx+1))
+		}
+		return anydiff.Concat(res...)
+	})
+}
+
+// SerializerType returns the unique ID used to serialize
+// a Channel with the serializer package.
+func (c *Channel) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.Channel"
+}
+
+// Serialize serializes the layer.
+func (c *Channel) Serialize() ([]byte, error) {
+	return serializer.SerializeAny(c.Index)
+}
+
+// ScaledSigmoid is an anynet.Layer which computes
+//
+//     max * sigmoid(x)
+//
+// where max is a learned, positive scalar.
+//
+// A ScaledSigmoid can be used in a StepSize gate to
+// bound the step sizes.
+type ScaledSigmoid struct {
+	// LogMax stores the logarithm of the maximum.
+	LogMax *anydiff.Var
+}
+
+// NewScaledSigmoid creates a ScaledSigmoid with the
+// initial maximum.
+func NewScaledSigmoid(c anyvec.Creator, max float64) *ScaledSigmoid {
+	logMax := c.MakeVectorData(c.MakeNumericList([]float64{math.Log(max)}))
+	return &ScaledSigmoid{LogMax: anydiff.NewVar(logMax)}
+}
+
+// DeserializeScaledSigmoid deserializes a ScaledSigmoid.
+func DeserializeScaledSigmoid(d []byte) (layer *ScaledSigmoid, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.ScaledSigmoid", &err)
+	var logMax *anyvecsave.S
+	if err := serializer.DeserializeAny(d, &logMax); err != nil {
+		return nil, err
+	}
+	return &ScaledSigmoid{LogMax: anydiff.NewVar(logMax.Vector)}, nil
+}
+
+// Apply applies the layer.
+func (s *ScaledSigmoid) Apply(in anydiff.Res, n int) anydiff.Res {
+	mat := &anydiff.Matrix{
+		Data: anydiff.Sigmoid(in),
+		Rows: 1,
+		Cols: in.Output().Len(),
+	}
+	return anydiff.ScaleRows(mat, anydiff.Exp(s.LogMax)).Data
+}
+
+// Parameters returns the learned maximum.
+func (s *ScaledSigmoid) Parameters() []*anydiff.Var {
+	return []*anydiff.Var{s.LogMax}
+}
+
+// SerializerType returns the unique ID used to serialize
+// a ScaledSigmoid with the serializer package.
+func (s *ScaledSigmoid) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.ScaledSigmoid"
+}
+
+// Serialize serializes the layer.
+func (s *ScaledSigmoid) Serialize() ([]byte, error) {
+	return serializer.SerializeAny(&anyvecsave.S{Vector: s.LogMax.Vector})
+}
+
+// TiedFC is an anynet.Layer which shares its weights with
+// an existing fully-connected layer, using the first
+// OutCount rows of the weight matrix.
+//
+// A TiedFC can be used as a Block's Query gate to tie the
+// query projection to the TrainInput projection (see
+// Block.TieKeys), so that the i-th query is addressed
+// like the i-th training key.
+//
+// Only the separate biases (if any) are serialized, so FC
+// must be set again after deserialization.
+// DeserializeBlock does this automatically.
+type TiedFC struct {
+	FC       *anynet.FC
+	OutCount int
+
+	// Biases, if non-nil, are used instead of the first
+	// OutCount biases of FC.
+	Biases *anydiff.Var
+}
+
+// DeserializeTiedFC deserializes a TiedFC.
+// The resulting layer's FC field is nil.
+func DeserializeTiedFC(d []byte) (layer *TiedFC, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.TiedFC", &err)
+	objs, err := serializer.DeserializeSlice(d)
+	if err != nil {
+		return nil, err
+	}
+	if len(objs) != 1 && len(objs) != 2 {
+		return nil, errors.New("invalid number of fields")
+	}
+	outCount, ok := objs[0].(serializer.Int)
+	if !ok {
+		return nil, fmt.Errorf("expected int but got %T", objs[0])
+	}
+	layer = &TiedFC{OutCount: int(outCount)}
+	if len(objs) == 2 {
+		biases, ok := objs[1].(*anyvecsave.S)
+		if !ok {
+			return nil, fmt.Errorf("expected vector but got %T", objs[1])
+		}
+		layer.Biases = anydiff.NewVar(biases.Vector)
+	}
+	return layer, nil
+}
+
+// Apply applies the layer.
+func (t *TiedFC) Apply(in anydiff.Res, n int) anydiff.Res {
+	if t.FC == nil {
+		panic("TiedFC is not tied to a layer")
+	} else if t.OutCount > t.FC.OutCount {
+		panic("TiedFC has more outputs than the layer it is tied to")
+	}
+	weights := &anydiff.Matrix{
+		Data: anydiff.Slice(t.FC.Weights, 0, t.OutCount*t.FC.InCount),
+		Rows: t.OutCount,
+		Cols: t.FC.InCount,
+	}
+	inMat := &anydiff.Matrix{Data: in, Rows: n, Cols: t.FC.InCount}
+	out := anydiff.MatMul(false, true, inMat, weights).Data
+	var biases anydiff.Res = t.Biases
+	if t.Biases == nil {
+		biases = anydiff.Slice(t.FC.Biases, 0, t.OutCount)
+	}
+	return anydiff.AddRepeated(out, biases)
+}
+
+// Parameters returns the separate biases, if there are
+// any.
+// The shared parameters are not included, since they
+// belong to FC.
+func (t *TiedFC) Parameters() []*anydiff.Var {
+	if t.Biases == nil {
+		return nil
+	}
+	return []*anydiff.Var{t.Biases}
+}
+
+// SerializerType returns the unique ID used to serialize
+// a TiedFC with the serializer package.
+func (t *TiedFC) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.TiedFC"
+}
+
+// Serialize serializes the layer.
+func (t *TiedFC) Serialize() ([]byte, error) {
+	fields := []serializer.Serializer{serializer.Int(t.OutCount)}
+	if t.Biases != nil {
+		fields = append(fields, &anyvecsave.S{Vector: t.Biases.Vector})
+	}
+	return serializer.SerializeSlice(fields)
+}
+
+// Softmax is an anynet.Layer which applies the softmax
+// function to every consecutive chunk of ChunkSize
+// components.
+//
+// A Softmax can be used in a Block's TrainInput and Query
+// gates to produce soft one-hot keys for an embedding
+// table (see EmbeddingBlock).
+type Softmax struct {
+	ChunkSize int
+}
+
+// DeserializeSoftmax deserializes a Softmax.
+func DeserializeSoftmax(d []byte) (layer *Softmax, err error) {
+	defer essentials.AddCtxTo("deserialize sgdstore.Softmax", &err)
+	layer = &Softmax{}
+	if err := serializer.DeserializeAny(d, &layer.ChunkSize); err != nil {
+		return nil, err
+	}
+	return layer, nil
+}
+
+// Apply applies the layer.
+func (s *Softmax) Apply(in anydiff.Res, n int) anydiff.Res {
+	if in.Output().Len()%s.ChunkSize != 0 {
+		panic("input size must be divisible by chunk size")
+	}
+	return anydiff.Exp(anydiff.LogSoftmax(in, s.ChunkSize))
+}
+
+// SerializerType returns the unique ID used to serialize
+// a Softmax with the serializer package.
+func (s *Softmax) SerializerType() string {
+	return "github.com/unixpickle/sgdstore.Softmax"
+}
+
+// Serialize serializes the layer.
+func (s *Softmax) Serialize() ([]byte, error) {
+	return serializer.SerializeAny(s.ChunkSize)
+}
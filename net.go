@@ -2,8 +2,11 @@ package sgdstore
 
 import (
 	"fmt"
+	"math/rand"
+	"sort"
 
 	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
 )
 
 // NetBatch is a batch of dynamic feed-forward multi-layer
@@ -26,22 +29,182 @@ type Net struct {
 
 	// Activation is the activation function.
 	Activation Activation
+
+	// GradClip, if non-zero, is the maximum norm of each
+	// network's gradient during training.
+	// Gradients with larger norms are scaled down.
+	GradClip float64
+
+	// LinearOutput, if true, indicates that the final
+	// layer should not be followed by an activation.
+	LinearOutput bool
+
+	// Conv, if non-nil, specifies which layers are
+	// convolutional.
+	// Conv[i] describes the i-th layer, and a nil or
+	// missing entry indicates a fully-connected layer.
+	// Each example in a batch is an image of the size
+	// expected by the first convolutional layer, and the
+	// output of a convolutional layer is an image with one
+	// channel per bias.
+	Conv []*ConvLayer
+
+	// NormKeys, if true, indicates that every input (i.e.
+	// key) should be scaled to have unit L2 norm before it
+	// is fed to the first layer.
+	// This applies to training as well as to Apply.
+	NormKeys bool
+
+	// Embedding, if true, indicates that the first layer
+	// is an embedding table addressed by soft one-hot keys.
+	// Each input should be a distribution over the table's
+	// entries (e.g. the output of a softmax), and each
+	// column of the first weight matrix is an entry.
+	// The first layer is not followed by an activation, so
+	// a one-hot input selects an entry (plus the biases).
+	Embedding bool
+
+	// EmbeddingTopK, if non-zero, keeps only the
+	// EmbeddingTopK largest components of each input to an
+	// embedding table, renormalizing them to sum to 1.
+	// Since the other components are zero, each example
+	// only updates EmbeddingTopK entries of the table
+	// during training.
+	EmbeddingTopK int
+
+	// Elastic, if non-nil, contains a coefficient λ for each
+	// network.
+	// During training, the term
+	//
+	//     λ*||θ - anchor||^2
+	//
+	// is added to each network's loss, pulling the
+	// parameters θ towards the anchor parameters.
+	// It is not included in the result of Loss.
+	Elastic anydiff.Res
+
+	// Anchor contains the anchor parameters for Elastic,
+	// in the same format as Parameters.
+	Anchor []anydiff.Res
+
+	// Decay, if non-zero, adds an L2 penalty
+	//
+	//     Decay*||θ||^2
+	//
+	// to each network's loss during training.
+	// Like Elastic, it is not included in the result of
+	// Loss.
+	Decay float64
+
+	// Subset, if non-zero, is the number of examples from
+	// each network's batch to use at each step of
+	// training.
+	// A different random subset is chosen for every step.
+	Subset int
+
+	// KeyDropout, if non-zero, is the probability with
+	// which each component of the input batch is zeroed
+	// at each step of training.
+	// The remaining components are scaled up accordingly.
+	KeyDropout float64
+
+	// Rand, if non-nil, is the source of randomness for
+	// Subset and KeyDropout.
+	// If it is nil, the math/rand package is used.
+	Rand *rand.Rand
+
+	// ExampleWeights, if non-nil, contains a weight for
+	// every example in every network's batch.
+	// During training, each example's gradient is scaled
+	// by its weight.
+	// A negative weight causes training to move away from
+	// the example's target, erasing it from the network.
+	// Like Elastic, it does not affect the result of Loss.
+	ExampleWeights anydiff.Res
+
+	// LossWeights, if non-nil, contains a weight for every
+	// example in every network's batch.
+	// Loss scales each example's squared error by its
+	// weight before averaging.
+	// It does not affect training.
+	LossWeights anydiff.Res
+
+	// check, if non-nil, is used to find non-finite values
+	// during training.
+	check *finiteChecker
 }
 
 // Apply applies the networks to a batch of input batches,
 // producing a batch of output batches.
 func (n *Net) Apply(inBatch anydiff.Res, batchSize int) anydiff.Res {
+	inBatch = n.prepareKeys(inBatch, batchSize)
 	return anydiff.Unfuse(n.Parameters, func(params []anydiff.Res) anydiff.Res {
 		if len(params)%2 != 0 {
 			panic("mismatching bias and weight count")
 		}
 		for i := 0; i < len(params); i += 2 {
-			inBatch = n.applyLayer(params[i], params[i+1], inBatch, batchSize, n.Num)
+			last := i+2 == len(params)
+			inBatch = n.applyLayer(params[i], params[i+1], inBatch, batchSize, n.Num,
+				i/2, last)
 		}
 		return inBatch
 	})
 }
 
+// ApplyAll is like Apply, but it produces the output of
+// every layer (after its activation), starting with the
+// first layer and ending with the output layer.
+func (n *Net) ApplyAll(inBatch anydiff.Res, batchSize int) anydiff.MultiRes {
+	inBatch = n.prepareKeys(inBatch, batchSize)
+	return anydiff.PoolMulti(n.Parameters, func(params []anydiff.Res) anydiff.MultiRes {
+		if len(params)%2 != 0 {
+			panic("mismatching bias and weight count")
+		}
+		return n.applyAll(params, inBatch, batchSize, 0)
+	})
+}
+
+// applyAll implements ApplyAll for the layers starting
+// at the given index.
+// The caller should pool the parameters.
+func (n *Net) applyAll(params []anydiff.Res, inBatch anydiff.Res, batchSize,
+	layer int) anydiff.MultiRes {
+	last := len(params) == 2
+	out := n.applyLayer(params[0], params[1], inBatch, batchSize, n.Num, layer, last)
+	if last {
+		return anydiff.Fuse(out)
+	}
+	return anydiff.PoolFork(out, func(out anydiff.Res) anydiff.MultiRes {
+		rest := n.applyAll(params[2:], out, batchSize, layer+1)
+		return anydiff.PoolMulti(rest, func(rest []anydiff.Res) anydiff.MultiRes {
+			return anydiff.Fuse(append([]anydiff.Res{out}, rest...)...)
+		})
+	})
+}
+
+// Loss computes the mean squared error of each network
+// on its batch, producing one value per network.
+//
+// This is the loss which Train minimizes.
+func (n *Net) Loss(inBatch, target anydiff.Res, batchSize int) anydiff.Res {
+	out := n.Apply(inBatch, batchSize)
+	if out.Output().Len() != target.Output().Len() {
+		panic(fmt.Sprintf("target length %d (expected %d)", target.Output().Len(),
+			out.Output().Len()))
+	}
+	cols := out.Output().Len() / n.Num
+	sqErr := &anydiff.Matrix{
+		Data: anydiff.Square(anydiff.Sub(out, target)),
+		Rows: n.Num,
+		Cols: cols,
+	}
+	if n.LossWeights != nil {
+		sqErr.Data = maskRows(sqErr.Data, n.LossWeights, n.Num*batchSize)
+	}
+	scaler := target.Output().Creator().MakeNumeric(1 / float64(cols))
+	return anydiff.Scale(anydiff.SumCols(sqErr), scaler)
+}
+
 // InSize calculates the input size of the network using
 // the dimensions of the first layer.
 //
@@ -50,11 +213,17 @@ func (n *Net) InSize() int {
 	if len(n.Parameters.Outputs()) < 2 {
 		panic("network cannot be empty")
 	}
+	if conv := n.convLayer(0); conv != nil {
+		return conv.InSize()
+	}
 	return n.Parameters.Outputs()[0].Len() / n.Parameters.Outputs()[1].Len()
 }
 
 // Train performs SGD training on the batch.
 //
+// The trained Net keeps all of n's settings, including
+// Activation.
+//
 // The input, target, and stepSize needn't be pooled by
 // the caller.
 func (n *Net) Train(inBatch, target, stepSize anydiff.Res, batchSize,
@@ -63,15 +232,66 @@ func (n *Net) Train(inBatch, target, stepSize anydiff.Res, batchSize,
 		panic("invalid stepSize length")
 	}
 	ins := anydiff.Fuse(inBatch, target, stepSize)
-	newParams := anydiff.PoolMulti(ins, func(s []anydiff.Res) anydiff.MultiRes {
-		inBatch, target, stepSize := s[0], s[1], s[2]
-		net := n
-		for i := 0; i < numSteps; i++ {
-			net = net.step(inBatch, target, stepSize, batchSize)
+	newParams := n.poolShared(func(net *Net) anydiff.MultiRes {
+		return anydiff.PoolMulti(ins, func(s []anydiff.Res) anydiff.MultiRes {
+			inBatch, target, stepSize := s[0], s[1], s[2]
+			for i := 0; i < numSteps; i++ {
+				net = net.step(inBatch, target, stepSize, batchSize)
+			}
+			return net.Parameters
+		})
+	})
+	return n.withParameters(newParams)
+}
+
+// TrainLosses is like Train, but it also computes the
+// loss of each network before every step and after the
+// final step.
+//
+// The result is [param1, param2, ..., losses], where the
+// losses vector contains numSteps+1 consecutive values
+// for each network.
+func (n *Net) TrainLosses(inBatch, target, stepSize anydiff.Res, batchSize,
+	numSteps int) anydiff.MultiRes {
+	if stepSize.Output().Len() != n.Num {
+		panic("invalid stepSize length")
+	}
+	numParams := len(n.Parameters.Outputs())
+	ins := anydiff.Fuse(inBatch, target, stepSize)
+	return n.poolShared(func(net *Net) anydiff.MultiRes {
+		return anydiff.PoolMulti(ins, func(s []anydiff.Res) anydiff.MultiRes {
+			inBatch, target, stepSize := s[0], s[1], s[2]
+			res := net.trainLosses(inBatch, target, stepSize, batchSize, numSteps)
+			return anydiff.PoolMulti(res, func(x []anydiff.Res) anydiff.MultiRes {
+				losses := batchedConcat(n.Num, x[numParams:]...)
+				return anydiff.Fuse(append(x[:numParams:numParams], losses)...)
+			})
+		})
+	})
+}
+
+// trainLosses performs numSteps steps of training and
+// produces [param1, param2, ..., loss0, loss1, ...].
+//
+// The input, target, and stepSize should be pooled by the
+// caller.
+func (n *Net) trainLosses(inBatch, target, stepSize anydiff.Res, batchSize,
+	numSteps int) anydiff.MultiRes {
+	return anydiff.PoolMulti(n.Parameters, func(params []anydiff.Res) anydiff.MultiRes {
+		net := n.withParameters(anydiff.Fuse(params...))
+		loss := net.Loss(inBatch, target, batchSize)
+		if numSteps == 0 {
+			return anydiff.Fuse(append(params[:len(params):len(params)], loss)...)
 		}
-		return net.Parameters
+		next := net.step(inBatch, target, stepSize, batchSize)
+		rest := next.trainLosses(inBatch, target, stepSize, batchSize, numSteps-1)
+		return anydiff.PoolMulti(rest, func(x []anydiff.Res) anydiff.MultiRes {
+			res := append([]anydiff.Res{}, x[:len(params)]...)
+			res = append(res, loss)
+			res = append(res, x[len(params):]...)
+			return anydiff.Fuse(res...)
+		})
 	})
-	return &Net{Parameters: newParams, Num: n.Num}
 }
 
 // step performs a step of gradient descent and returns
@@ -81,37 +301,326 @@ func (n *Net) Train(inBatch, target, stepSize anydiff.Res, batchSize,
 // caller.
 func (n *Net) step(inBatch, target, stepSize anydiff.Res, batchSize int) *Net {
 	newParams := anydiff.PoolMulti(n.Parameters, func(params []anydiff.Res) anydiff.MultiRes {
-		grad := n.applyBackprop(params, inBatch, target, batchSize, n.Num)
+		grad := n.backprop(params, inBatch, target, batchSize)
 		return anydiff.PoolMulti(grad, func(grads []anydiff.Res) anydiff.MultiRes {
-			var newParams []anydiff.Res
-			for i, g := range grads[1:] {
-				gMat := &anydiff.Matrix{
-					Data: g,
-					Rows: n.Num,
-					Cols: g.Output().Len() / n.Num,
+			grads = n.regularize(params, grads[1:])
+			if n.check != nil {
+				n.check.CheckParams(resOutputs(grads), " gradient")
+			}
+			scales := stepSize
+			if n.GradClip != 0 {
+				scales = anydiff.Mul(stepSize, n.clipScales(grads))
+			}
+			return anydiff.PoolFork(scales, func(scales anydiff.Res) anydiff.MultiRes {
+				var newParams []anydiff.Res
+				for i, g := range grads {
+					gMat := &anydiff.Matrix{
+						Data: g,
+						Rows: n.Num,
+						Cols: g.Output().Len() / n.Num,
+					}
+					p := anydiff.Add(params[i], anydiff.ScaleRows(gMat, scales).Data)
+					newParams = append(newParams, p)
 				}
-				p := anydiff.Add(params[i], anydiff.ScaleRows(gMat, stepSize).Data)
-				newParams = append(newParams, p)
+				if n.check != nil {
+					n.check.CheckParams(resOutputs(newParams), "")
+					n.check.Step++
+				}
+				return anydiff.Fuse(newParams...)
+			})
+		})
+	})
+	return n.withParameters(newParams)
+}
+
+// backprop is like applyBackprop, but it uses a random
+// subset of the examples and applies dropout to the
+// inputs according to n.Subset and n.KeyDropout.
+// It also prepares the inputs with prepareKeys.
+func (n *Net) backprop(params []anydiff.Res, inBatch, target anydiff.Res,
+	batchSize int) anydiff.MultiRes {
+	weights := n.exampleWeights(batchSize)
+	inBatch = n.prepareKeys(inBatch, batchSize)
+	if n.KeyDropout == 0 {
+		return n.applyBackprop(params, inBatch, target, weights, batchSize, n.Num)
+	}
+	c := inBatch.Output().Creator()
+	mask := make([]float64, inBatch.Output().Len())
+	for i := range mask {
+		if n.randFloat() >= n.KeyDropout {
+			mask[i] = 1 / (1 - n.KeyDropout)
+		}
+	}
+	maskVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(mask)))
+	return anydiff.PoolFork(anydiff.Mul(inBatch, maskVec),
+		func(inBatch anydiff.Res) anydiff.MultiRes {
+			return n.applyBackprop(params, inBatch, target, weights, batchSize, n.Num)
+		})
+}
+
+// exampleWeights produces a weight for every example in
+// every network's batch, or nil if every example should
+// have weight 1.
+// This combines n.ExampleWeights with the weights from
+// subsetWeights.
+func (n *Net) exampleWeights(batchSize int) anydiff.Res {
+	subset := n.subsetWeights(batchSize)
+	if subset == nil {
+		return n.ExampleWeights
+	} else if n.ExampleWeights == nil {
+		return subset
+	}
+	return anydiff.Mul(subset, n.ExampleWeights)
+}
+
+// subsetWeights produces example weights for n.Subset, or
+// nil if every example is used.
+// Examples outside of a network's random subset have
+// weight 0, and the others are scaled up so that the
+// mean loss is unaffected.
+func (n *Net) subsetWeights(batchSize int) anydiff.Res {
+	if n.Subset == 0 || n.Subset >= batchSize {
+		return nil
+	}
+	weights := make([]float64, batchSize*n.Num)
+	for i := 0; i < n.Num; i++ {
+		for _, j := range n.randPerm(batchSize)[:n.Subset] {
+			weights[i*batchSize+j] = float64(batchSize) / float64(n.Subset)
+		}
+	}
+	c := n.Parameters.Outputs()[0].Creator()
+	return anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(weights)))
+}
+
+func (n *Net) randFloat() float64 {
+	return randFloat(n.Rand)
+}
+
+func (n *Net) randPerm(size int) []int {
+	if n.Rand != nil {
+		return n.Rand.Perm(size)
+	}
+	return rand.Perm(size)
+}
+
+// regularize adds the gradients of the Elastic and Decay
+// terms to the gradients (which point downhill).
+func (n *Net) regularize(params, grads []anydiff.Res) []anydiff.Res {
+	if n.Elastic == nil && n.Decay == 0 {
+		return grads
+	}
+	c := params[0].Output().Creator()
+	res := make([]anydiff.Res, len(grads))
+	for i, g := range grads {
+		if n.Decay != 0 {
+			g = anydiff.Sub(g, anydiff.Scale(params[i], c.MakeNumeric(2*n.Decay)))
+		}
+		if n.Elastic != nil {
+			diff := &anydiff.Matrix{
+				Data: anydiff.Scale(anydiff.Sub(n.Anchor[i], params[i]), c.MakeNumeric(2)),
+				Rows: n.Num,
+				Cols: params[i].Output().Len() / n.Num,
 			}
-			return anydiff.Fuse(newParams...)
+			g = anydiff.Add(g, anydiff.ScaleRows(diff, n.Elastic).Data)
+		}
+		res[i] = g
+	}
+	return res
+}
+
+// poolShared pools n.Elastic, n.Anchor, and
+// n.ExampleWeights, since they are used at every step of
+// training.
+// It calls f with a copy of n that uses the pooled
+// results.
+func (n *Net) poolShared(f func(n *Net) anydiff.MultiRes) anydiff.MultiRes {
+	if n.ExampleWeights != nil {
+		return anydiff.PoolFork(n.ExampleWeights,
+			func(weights anydiff.Res) anydiff.MultiRes {
+				res := *n
+				res.ExampleWeights = weights
+				return res.poolElastic(f)
+			})
+	}
+	return n.poolElastic(f)
+}
+
+// poolElastic is like poolShared, but it only pools
+// n.Elastic and n.Anchor.
+func (n *Net) poolElastic(f func(n *Net) anydiff.MultiRes) anydiff.MultiRes {
+	if n.Elastic == nil {
+		return f(n)
+	}
+	if len(n.Anchor) != len(n.Parameters.Outputs()) {
+		panic("anchor must match parameters")
+	}
+	ins := anydiff.Fuse(append([]anydiff.Res{n.Elastic}, n.Anchor...)...)
+	return anydiff.PoolMulti(ins, func(x []anydiff.Res) anydiff.MultiRes {
+		res := *n
+		res.Elastic = x[0]
+		res.Anchor = x[1:]
+		return f(&res)
+	})
+}
+
+// clipScales computes the amount by which to scale each
+// network's gradient to clip its norm.
+func (n *Net) clipScales(grads []anydiff.Res) anydiff.Res {
+	var sqNorms anydiff.Res
+	for _, g := range grads {
+		sqMat := &anydiff.Matrix{
+			Data: anydiff.Square(g),
+			Rows: n.Num,
+			Cols: g.Output().Len() / n.Num,
+		}
+		sqNorms = addOrSet(sqNorms, anydiff.SumCols(sqMat))
+	}
+
+	// Only the networks which exceed the threshold depend
+	// on their gradient norms.
+	clipMask := make([]float64, n.Num)
+	keepMask := make([]float64, n.Num)
+	for i, sqNorm := range vecFloats(sqNorms.Output()) {
+		if sqNorm > n.GradClip*n.GradClip {
+			clipMask[i] = 1
+		} else {
+			keepMask[i] = 1
+		}
+	}
+	c := sqNorms.Output().Creator()
+	clipVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(clipMask)))
+	keepVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(keepMask)))
+
+	// Replace the norms of the other networks with 1, since
+	// they may be 0 and would produce infinities.
+	safeNorms := anydiff.Add(anydiff.Mul(clipVec, sqNorms), keepVec)
+	clipped := anydiff.Scale(anydiff.Pow(safeNorms, c.MakeNumeric(-0.5)),
+		c.MakeNumeric(n.GradClip))
+	return anydiff.Add(anydiff.Mul(clipVec, clipped), keepVec)
+}
+
+// withParameters creates a copy of n with different
+// parameters.
+func (n *Net) withParameters(params anydiff.MultiRes) *Net {
+	res := *n
+	res.Parameters = params
+	return &res
+}
+
+// selectNets creates a batch containing the networks
+// with the given indices, along with their Elastic,
+// Anchor, ExampleWeights, and LossWeights entries.
+//
+// If n checks for non-finite values, the result uses a
+// separate checker whose Err and Step the caller should
+// copy back.
+func (n *Net) selectNets(indices []int) *Net {
+	res := *n
+	res.Num = len(indices)
+	res.Parameters = anydiff.PoolMulti(n.Parameters,
+		func(params []anydiff.Res) anydiff.MultiRes {
+			var selected []anydiff.Res
+			for _, p := range params {
+				selected = append(selected, selectChunks(p, n.Num, indices))
+			}
+			return anydiff.Fuse(selected...)
+		})
+	if n.Elastic != nil {
+		res.Elastic = selectChunks(n.Elastic, n.Num, indices)
+		res.Anchor = nil
+		for _, a := range n.Anchor {
+			res.Anchor = append(res.Anchor, selectChunks(a, n.Num, indices))
+		}
+	}
+	if n.ExampleWeights != nil {
+		res.ExampleWeights = selectChunks(n.ExampleWeights, n.Num, indices)
+	}
+	if n.LossWeights != nil {
+		res.LossWeights = selectChunks(n.LossWeights, n.Num, indices)
+	}
+	if n.check != nil {
+		check := *n.check
+		check.Sequences = nil
+		for _, i := range indices {
+			check.Sequences = append(check.Sequences, n.check.Sequences[i])
+		}
+		res.check = &check
+	}
+	return &res
+}
+
+// insertNets replaces the parameters of the networks with
+// the given indices by the parameters of sub, which
+// should have the layout produced by selectNets.
+func (n *Net) insertNets(sub anydiff.MultiRes, indices []int) anydiff.MultiRes {
+	return anydiff.PoolMulti(n.Parameters, func(params []anydiff.Res) anydiff.MultiRes {
+		return anydiff.PoolMulti(sub, func(subParams []anydiff.Res) anydiff.MultiRes {
+			var res []anydiff.Res
+			for i, p := range params {
+				chunks := splitVec(p, n.Num)
+				for j, subChunk := range splitVec(subParams[i], len(indices)) {
+					chunks[indices[j]] = subChunk
+				}
+				res = append(res, anydiff.Concat(chunks...))
+			}
+			return anydiff.Fuse(res...)
 		})
 	})
-	return &Net{Parameters: newParams, Num: n.Num}
+}
+
+// activation gets the activation function for a layer.
+func (n *Net) activation(layer int, last bool) Activation {
+	if (last && n.LinearOutput) || (layer == 0 && n.Embedding) {
+		return Linear
+	}
+	return n.Activation
+}
+
+// prepareKeys normalizes the inputs if n.NormKeys is set
+// and sparsifies them if n.EmbeddingTopK is set.
+func (n *Net) prepareKeys(inBatch anydiff.Res, batchSize int) anydiff.Res {
+	rows := batchSize * n.Num
+	cols := inBatch.Output().Len() / rows
+	if n.NormKeys {
+		inBatch = normalizeRows(&anydiff.Matrix{Data: inBatch, Rows: rows, Cols: cols})
+	}
+	if n.Embedding && n.EmbeddingTopK != 0 && n.EmbeddingTopK < cols {
+		inBatch = topKRows(&anydiff.Matrix{Data: inBatch, Rows: rows, Cols: cols},
+			n.EmbeddingTopK)
+	}
+	return inBatch
+}
+
+// convLayer gets the convolutional structure of a layer,
+// or nil if the layer is fully-connected.
+func (n *Net) convLayer(layer int) *ConvLayer {
+	if layer < len(n.Conv) {
+		return n.Conv[layer]
+	}
+	return nil
 }
 
 // applyLayer applies a single layer.
 func (n *Net) applyLayer(weights, biases, inBatch anydiff.Res, batchSize,
-	numNets int) anydiff.Res {
+	numNets, layer int, last bool) anydiff.Res {
+	if conv := n.convLayer(layer); conv != nil {
+		inBatch = conv.patches(inBatch, batchSize*numNets)
+		batchSize *= conv.NumPatches()
+	}
 	inMat, weightMat := layerMats(weights, biases, inBatch, batchSize, numNets)
 	inBatch = anydiff.BatchedMatMul(false, true, inMat, weightMat).Data
-	return n.Activation.Forward(batchedAddRepeated(inBatch, biases, numNets))
+	return n.activation(layer, last).Forward(batchedAddRepeated(inBatch, biases, numNets))
 }
 
 // applyBackprop applies the networks and performs
 // backward-propagation.
 // The result is [inGrad, param1Grad, param2Grad, ...].
 // The caller should pool the input parameters.
-func (n *Net) applyBackprop(params []anydiff.Res, in, target anydiff.Res,
+//
+// If weights is non-nil, it contains a weight for each
+// example in each network's batch, and each example's
+// gradient is scaled by its weight.
+func (n *Net) applyBackprop(params []anydiff.Res, in, target, weights anydiff.Res,
 	batchSize, numNets int) anydiff.MultiRes {
 	if len(params) == 0 {
 		scaler := target.Output().Creator().MakeNumeric(
@@ -121,33 +630,61 @@ func (n *Net) applyBackprop(params []anydiff.Res, in, target anydiff.Res,
 			panic(fmt.Sprintf("target length %d (expected %d)", target.Output().Len(),
 				in.Output().Len()))
 		}
-		return anydiff.Fuse(anydiff.Scale(anydiff.Sub(target, in), scaler))
-	}
-	inMat, weightMat := layerMats(params[0], params[1], in, batchSize, numNets)
-	matOut := anydiff.BatchedMatMul(false, true, inMat, weightMat).Data
-	biasOut := batchedAddRepeated(matOut, params[1], numNets)
-	actOut := n.Activation.Forward(biasOut)
-	return anydiff.PoolFork(actOut, func(actOut anydiff.Res) anydiff.MultiRes {
-		nextOut := n.applyBackprop(params[2:], actOut, target, batchSize, numNets)
-		return anydiff.PoolMulti(nextOut, func(x []anydiff.Res) anydiff.MultiRes {
-			outGrad := x[0]
-			laterGrads := x[1:]
-			pg := n.Activation.Backward(actOut, outGrad)
-			return anydiff.PoolFork(pg, func(pg anydiff.Res) anydiff.MultiRes {
-				productGrad := &anydiff.MatrixBatch{
-					Data: pg,
-					Rows: batchSize,
-					Cols: weightMat.Rows,
-					Num:  numNets,
-				}
-				weightGrad := anydiff.BatchedMatMul(true, false, productGrad, inMat).Data
-				biasGrad := batchedSumRows(productGrad)
-				inGrad := anydiff.BatchedMatMul(false, false, productGrad, weightMat).Data
-				ourGrad := []anydiff.Res{inGrad, weightGrad, biasGrad}
-				return anydiff.Fuse(append(ourGrad, laterGrads...)...)
+		grad := anydiff.Scale(anydiff.Sub(target, in), scaler)
+		if weights != nil {
+			grad = anydiff.ScaleRows(&anydiff.Matrix{
+				Data: grad,
+				Rows: batchSize * numNets,
+				Cols: in.Output().Len() / (batchSize * numNets),
+			}, weights).Data
+		}
+		return anydiff.Fuse(grad)
+	}
+
+	// Layers are counted from the start of n.Parameters,
+	// which params is a suffix of.
+	layer := (len(n.Parameters.Outputs()) - len(params)) / 2
+	conv := n.convLayer(layer)
+	layerOut := func(layerIn anydiff.Res) anydiff.MultiRes {
+		layerBatch := batchSize
+		if conv != nil {
+			layerBatch *= conv.NumPatches()
+		}
+		inMat, weightMat := layerMats(params[0], params[1], layerIn, layerBatch, numNets)
+		matOut := anydiff.BatchedMatMul(false, true, inMat, weightMat).Data
+		biasOut := batchedAddRepeated(matOut, params[1], numNets)
+		act := n.activation(layer, len(params) == 2)
+		actOut := act.Forward(biasOut)
+		return anydiff.PoolFork(actOut, func(actOut anydiff.Res) anydiff.MultiRes {
+			nextOut := n.applyBackprop(params[2:], actOut, target, weights, batchSize,
+				numNets)
+			return anydiff.PoolMulti(nextOut, func(x []anydiff.Res) anydiff.MultiRes {
+				outGrad := x[0]
+				laterGrads := x[1:]
+				pg := act.Backward(actOut, outGrad)
+				return anydiff.PoolFork(pg, func(pg anydiff.Res) anydiff.MultiRes {
+					productGrad := &anydiff.MatrixBatch{
+						Data: pg,
+						Rows: layerBatch,
+						Cols: weightMat.Rows,
+						Num:  numNets,
+					}
+					weightGrad := anydiff.BatchedMatMul(true, false, productGrad, inMat).Data
+					biasGrad := batchedSumRows(productGrad)
+					inGrad := anydiff.BatchedMatMul(false, false, productGrad, weightMat).Data
+					if conv != nil {
+						inGrad = conv.unpatches(inGrad)
+					}
+					ourGrad := []anydiff.Res{inGrad, weightGrad, biasGrad}
+					return anydiff.Fuse(append(ourGrad, laterGrads...)...)
+				})
 			})
 		})
-	})
+	}
+	if conv == nil {
+		return layerOut(in)
+	}
+	return anydiff.PoolFork(conv.patches(in, batchSize*numNets), layerOut)
 }
 
 func layerMats(weights, biases, inBatch anydiff.Res, batchSize, numNets int) (inMat,
@@ -173,6 +710,56 @@ func layerMats(weights, biases, inBatch anydiff.Res, batchSize, numNets int) (in
 	return
 }
 
+// normalizeRows scales every row of a matrix to have unit
+// L2 norm.
+func normalizeRows(m *anydiff.Matrix) anydiff.Res {
+	return anydiff.Pool(m.Data, func(data anydiff.Res) anydiff.Res {
+		c := data.Output().Creator()
+		sqNorms := anydiff.SumCols(&anydiff.Matrix{
+			Data: anydiff.Square(data),
+			Rows: m.Rows,
+			Cols: m.Cols,
+		})
+		// Add a small constant to avoid dividing by zero.
+		scales := anydiff.Pow(anydiff.AddScalar(sqNorms, c.MakeNumeric(1e-8)),
+			c.MakeNumeric(-0.5))
+		mat := &anydiff.Matrix{Data: data, Rows: m.Rows, Cols: m.Cols}
+		return anydiff.ScaleRows(mat, scales).Data
+	})
+}
+
+// topKRows zeros all but the k largest components of
+// every row of a matrix and scales the rows so that the
+// remaining components sum to 1.
+// Gradients only flow through the remaining components.
+func topKRows(m *anydiff.Matrix, k int) anydiff.Res {
+	values := vecFloats(m.Data.Output())
+	mask := make([]float64, len(values))
+	for i := 0; i < m.Rows; i++ {
+		row := values[i*m.Cols : (i+1)*m.Cols]
+		order := make([]int, len(row))
+		for j := range order {
+			order[j] = j
+		}
+		sort.SliceStable(order, func(a, b int) bool {
+			return row[order[a]] > row[order[b]]
+		})
+		for _, j := range order[:k] {
+			mask[i*m.Cols+j] = 1
+		}
+	}
+	c := m.Data.Output().Creator()
+	maskVec := anydiff.NewConst(c.MakeVectorData(c.MakeNumericList(mask)))
+	return anydiff.Pool(anydiff.Mul(m.Data, maskVec), func(kept anydiff.Res) anydiff.Res {
+		sums := anydiff.SumCols(&anydiff.Matrix{Data: kept, Rows: m.Rows, Cols: m.Cols})
+		// Add a small constant to avoid dividing by zero.
+		scales := anydiff.Pow(anydiff.AddScalar(sums, c.MakeNumeric(1e-8)),
+			c.MakeNumeric(-1))
+		mat := &anydiff.Matrix{Data: kept, Rows: m.Rows, Cols: m.Cols}
+		return anydiff.ScaleRows(mat, scales).Data
+	})
+}
+
 func batchedAddRepeated(vec, biases anydiff.Res, n int) anydiff.Res {
 	return anydiff.Pool(vec, func(vec anydiff.Res) anydiff.Res {
 		return anydiff.Pool(biases, func(biases anydiff.Res) anydiff.Res {
@@ -206,3 +793,97 @@ func splitVec(vec anydiff.Res, n int) []anydiff.Res {
 	}
 	return chunks
 }
+
+// batchedSlice slices each of the n chunks of a vector
+// and concatenates the results.
+func batchedSlice(vec anydiff.Res, n, start, end int) anydiff.Res {
+	return anydiff.Pool(vec, func(vec anydiff.Res) anydiff.Res {
+		var res []anydiff.Res
+		for _, chunk := range splitVec(vec, n) {
+			res = append(res, anydiff.Slice(chunk, start, end))
+		}
+		return anydiff.Concat(res...)
+	})
+}
+
+// selectChunks selects the chunks with the given indices
+// from a vector of n chunks and concatenates them.
+func selectChunks(vec anydiff.Res, n int, indices []int) anydiff.Res {
+	return anydiff.Pool(vec, func(vec anydiff.Res) anydiff.Res {
+		chunks := splitVec(vec, n)
+		var res []anydiff.Res
+		for _, i := range indices {
+			res = append(res, chunks[i])
+		}
+		return anydiff.Concat(res...)
+	})
+}
+
+func repeatVec(vec anydiff.Res, n int) anydiff.Res {
+	reps := make([]anydiff.Res, n)
+	for i := range reps {
+		reps[i] = vec
+	}
+	return anydiff.Concat(reps...)
+}
+
+// batchedRepeat repeats each of the n chunks of a vector
+// the given number of times.
+func batchedRepeat(vec anydiff.Res, n, reps int) anydiff.Res {
+	return anydiff.Pool(vec, func(vec anydiff.Res) anydiff.Res {
+		var res []anydiff.Res
+		for _, chunk := range splitVec(vec, n) {
+			for i := 0; i < reps; i++ {
+				res = append(res, chunk)
+			}
+		}
+		return anydiff.Concat(res...)
+	})
+}
+
+// batchedConcat concatenates the vectors for each of n
+// networks, so that the result contains the first
+// network's chunks, then the second network's, etc.
+func batchedConcat(n int, vecs ...anydiff.Res) anydiff.Res {
+	if len(vecs) == 1 {
+		return vecs[0]
+	}
+	return anydiff.Unfuse(anydiff.Fuse(vecs...), func(vecs []anydiff.Res) anydiff.Res {
+		var chunks [][]anydiff.Res
+		for _, vec := range vecs {
+			chunks = append(chunks, splitVec(vec, n))
+		}
+		var res []anydiff.Res
+		for i := 0; i < n; i++ {
+			for _, vecChunks := range chunks {
+				res = append(res, vecChunks[i])
+			}
+		}
+		return anydiff.Concat(res...)
+	})
+}
+
+// resOutputs gets the output vectors of results.
+func resOutputs(reses []anydiff.Res) []anyvec.Vector {
+	res := make([]anyvec.Vector, len(reses))
+	for i, x := range reses {
+		res[i] = x.Output()
+	}
+	return res
+}
+
+// vecFloats converts a vector's data to float64 values.
+func vecFloats(vec anyvec.Vector) []float64 {
+	switch data := vec.Data().(type) {
+	case []float32:
+		res := make([]float64, len(data))
+		for i, x := range data {
+			res[i] = float64(x)
+		}
+		return res
+	case []float64:
+		return data
+	default:
+		panic(fmt.Sprintf("unsupported numeric type: %T", data))
+	}
+}
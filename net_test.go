@@ -1,9 +1,12 @@
 package sgdstore
 
 import (
+	"math"
+	"math/rand"
 	"testing"
 
 	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anydifftest"
 	"github.com/unixpickle/anynet"
 	"github.com/unixpickle/anyvec"
 	"github.com/unixpickle/anyvec/anyvec32"
@@ -30,6 +33,42 @@ func TestNetApply(t *testing.T) {
 	}
 }
 
+func TestNetApplyAll(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+
+	t.Run("Value", func(t *testing.T) {
+		actual := virtualNet.ApplyAll(input, 4).Outputs()
+		if len(actual) != 3 {
+			t.Fatalf("expected 3 outputs but got %d", len(actual))
+		}
+		for i, a := range actual {
+			expected := realNet[:2*(i+1)].Apply(input, 4).Output()
+			diff := a.Copy()
+			diff.Sub(expected)
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("layer %d: expected %v but got %v", i, expected.Data(), a.Data())
+			}
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				return anydiff.Unfuse(virtualNet.ApplyAll(input, 4),
+					func(outs []anydiff.Res) anydiff.Res {
+						return anydiff.Concat(outs...)
+					})
+			},
+			V: append([]*anydiff.Var{input}, realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+}
+
 func TestNetTrain(t *testing.T) {
 	c := anyvec64.CurrentCreator()
 	realNet, virtualNet := randomNetwork(c)
@@ -67,6 +106,388 @@ func TestNetTrain(t *testing.T) {
 	}
 }
 
+func TestNetTrainLosses(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+
+	inVec := c.MakeVector(12)
+	anyvec.Rand(inVec, anyvec.Normal, nil)
+	input := anydiff.NewVar(inVec)
+
+	targetVec := c.MakeVector(8)
+	anyvec.Rand(targetVec, anyvec.Normal, nil)
+	target := anydiff.NewVar(targetVec)
+
+	stepSize := c.MakeVector(1)
+	stepSize.AddScalar(c.MakeNumeric(0.1))
+
+	trained := virtualNet.TrainLosses(input, target, anydiff.NewConst(stepSize), 4, 2)
+	actual := trained.Outputs()
+	actualLosses := actual[len(actual)-1]
+	if actualLosses.Len() != 3 {
+		t.Fatalf("expected 3 losses but got %d", actualLosses.Len())
+	}
+
+	for i := 0; i < 3; i++ {
+		out := realNet.Apply(input, 4)
+		cost := anynet.MSE{}.Cost(target, out, 1)
+		expected := anyvec.Sum(cost.Output()).(float64)
+		loss := actualLosses.Data().([]float64)[i]
+		if math.Abs(loss-expected) > 1e-4 {
+			t.Errorf("loss %d: expected %f but got %f", i, expected, loss)
+		}
+		if i == 2 {
+			break
+		}
+		grad := anydiff.NewGrad(realNet.Parameters()...)
+		cost.Propagate(stepSize.Copy(), grad)
+		grad.Scale(c.MakeNumeric(-1))
+		grad.AddToVars()
+	}
+	for i, a := range actual[:len(actual)-1] {
+		x := realNet.Parameters()[i].Vector
+		diff := x.Copy()
+		diff.Sub(a)
+		maxDiff := anyvec.AbsMax(diff).(float64)
+		if maxDiff > 1e-4 {
+			t.Error("bad value for layer", i)
+		}
+	}
+}
+
+func TestNetGradClip(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+	virtualNet.GradClip = 0.1
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	target := anydiff.NewVar(c.MakeVector(8))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	t.Run("Gradients", func(t *testing.T) {
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				trained := virtualNet.Train(input, target, stepSize, 4, 2)
+				return anydiff.Unfuse(trained.Parameters,
+					func(params []anydiff.Res) anydiff.Res {
+						return anydiff.Concat(params...)
+					})
+			},
+			V: append([]*anydiff.Var{input, target, stepSize}, realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+
+	t.Run("Value", func(t *testing.T) {
+		actual := virtualNet.Train(input, target, stepSize, 4, 1).Parameters.Outputs()
+
+		cost := anynet.MSE{}.Cost(target, realNet.Apply(input, 4), 1)
+		grad := anydiff.NewGrad(realNet.Parameters()...)
+		cost.Propagate(c.MakeVectorData([]float64{1}), grad)
+		var sqNorm float64
+		for _, g := range grad {
+			sqNorm += g.Dot(g).(float64)
+		}
+		if math.Sqrt(sqNorm) <= virtualNet.GradClip {
+			t.Fatal("gradient is too small to test clipping")
+		}
+		grad.Scale(c.MakeNumeric(-0.1 * virtualNet.GradClip / math.Sqrt(sqNorm)))
+
+		for i, param := range realNet.Parameters() {
+			expected := param.Vector.Copy()
+			expected.Add(grad[param])
+			diff := expected.Copy()
+			diff.Sub(actual[i])
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("bad value for layer %d", i)
+			}
+		}
+	})
+
+	t.Run("ZeroGradient", func(t *testing.T) {
+		// A target equal to the output gives an exactly
+		// zero gradient.
+		exact := anydiff.NewConst(virtualNet.Apply(input, 4).Output().Copy())
+		trained := virtualNet.Train(input, exact, stepSize, 4, 1)
+		params := trained.Parameters
+		for i, p := range params.Outputs() {
+			diff := p.Copy()
+			diff.Sub(realNet.Parameters()[i].Vector)
+			if maxDiff := anyvec.AbsMax(diff).(float64); maxDiff != 0 {
+				t.Errorf("layer %d changed by %f", i, maxDiff)
+			}
+		}
+
+		grad := anydiff.NewGrad(append([]*anydiff.Var{input, stepSize},
+			realNet.Parameters()...)...)
+		var upstream []anyvec.Vector
+		for _, p := range params.Outputs() {
+			ones := c.MakeVector(p.Len())
+			ones.AddScalar(c.MakeNumeric(1))
+			upstream = append(upstream, ones)
+		}
+		params.Propagate(upstream, grad)
+		for _, g := range grad {
+			for _, x := range vecFloats(g) {
+				if math.IsNaN(x) || math.IsInf(x, 0) {
+					t.Fatal("non-finite gradient")
+				}
+			}
+		}
+	})
+}
+
+func TestNetRegularization(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	target := anydiff.NewVar(c.MakeVector(8))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1}))
+	elastic := anydiff.NewVar(c.MakeVectorData([]float64{0.3}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	var anchor []*anydiff.Var
+	for _, param := range realNet.Parameters() {
+		v := anydiff.NewVar(param.Vector.Copy())
+		anyvec.Rand(v.Vector, anyvec.Normal, nil)
+		anchor = append(anchor, v)
+		virtualNet.Anchor = append(virtualNet.Anchor, v)
+	}
+	virtualNet.Elastic = elastic
+	virtualNet.Decay = 0.2
+
+	t.Run("Gradients", func(t *testing.T) {
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				trained := virtualNet.Train(input, target, stepSize, 4, 2)
+				return anydiff.Unfuse(trained.Parameters,
+					func(params []anydiff.Res) anydiff.Res {
+						return anydiff.Concat(params...)
+					})
+			},
+			V: append(append([]*anydiff.Var{input, target, stepSize, elastic}, anchor...),
+				realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+
+	t.Run("Value", func(t *testing.T) {
+		actual := virtualNet.Train(input, target, stepSize, 4, 1).Parameters.Outputs()
+
+		cost := anynet.MSE{}.Cost(target, realNet.Apply(input, 4), 1)
+		grad := anydiff.NewGrad(realNet.Parameters()...)
+		cost.Propagate(c.MakeVectorData([]float64{1}), grad)
+
+		for i, param := range realNet.Parameters() {
+			g := grad[param]
+			decay := param.Vector.Copy()
+			decay.Scale(c.MakeNumeric(2 * virtualNet.Decay))
+			g.Add(decay)
+			pull := param.Vector.Copy()
+			pull.Sub(anchor[i].Vector)
+			pull.Scale(c.MakeNumeric(2 * 0.3))
+			g.Add(pull)
+
+			expected := param.Vector.Copy()
+			g.Scale(c.MakeNumeric(-0.1))
+			expected.Add(g)
+			diff := expected.Copy()
+			diff.Sub(actual[i])
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("bad value for layer %d", i)
+			}
+		}
+	})
+}
+
+func TestNetSubset(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	target := anydiff.NewVar(c.MakeVector(8))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	t.Run("Gradients", func(t *testing.T) {
+		net := *virtualNet
+		net.Subset = 2
+		net.KeyDropout = 0.3
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				// Every evaluation must use the same samples.
+				net.Rand = rand.New(rand.NewSource(1337))
+				trained := net.Train(input, target, stepSize, 4, 3)
+				return anydiff.Unfuse(trained.Parameters,
+					func(params []anydiff.Res) anydiff.Res {
+						return anydiff.Concat(params...)
+					})
+			},
+			V: append([]*anydiff.Var{input, target, stepSize}, realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+
+	t.Run("Value", func(t *testing.T) {
+		net := *virtualNet
+		net.Subset = 2
+		net.Rand = rand.New(rand.NewSource(1337))
+		actual := net.Train(input, target, stepSize, 4, 1).Parameters.Outputs()
+
+		var subsetIn, subsetTarget []anyvec.Vector
+		for _, i := range rand.New(rand.NewSource(1337)).Perm(4)[:2] {
+			subsetIn = append(subsetIn, input.Vector.Slice(i*3, (i+1)*3))
+			subsetTarget = append(subsetTarget, target.Vector.Slice(i*2, (i+1)*2))
+		}
+		expected := virtualNet.Train(anydiff.NewConst(c.Concat(subsetIn...)),
+			anydiff.NewConst(c.Concat(subsetTarget...)), stepSize, 2, 1).Parameters.Outputs()
+
+		for i, x := range expected {
+			diff := x.Copy()
+			diff.Sub(actual[i])
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("bad value for layer %d", i)
+			}
+		}
+	})
+}
+
+func TestNetNormKeys(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	target := anydiff.NewVar(c.MakeVector(8))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+
+	normNet := *virtualNet
+	normNet.NormKeys = true
+
+	t.Run("Value", func(t *testing.T) {
+		normalized := append([]float64{}, vecFloats(input.Vector)...)
+		for i := 0; i < 4; i++ {
+			row := normalized[i*3 : (i+1)*3]
+			norm := math.Sqrt(dotFloats(row, row))
+			for j := range row {
+				row[j] /= norm
+			}
+		}
+		normIn := anydiff.NewConst(c.MakeVectorData(normalized))
+
+		actual := normNet.Apply(input, 4).Output()
+		expected := virtualNet.Apply(normIn, 4).Output()
+		diff := actual.Copy()
+		diff.Sub(expected)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+		}
+
+		actualParams := normNet.Train(input, target, stepSize, 4, 2).Parameters.Outputs()
+		expectedParams := virtualNet.Train(normIn, target, stepSize, 4, 2).Parameters.Outputs()
+		for i, x := range expectedParams {
+			diff := x.Copy()
+			diff.Sub(actualParams[i])
+			if anyvec.AbsMax(diff).(float64) > 1e-4 {
+				t.Errorf("bad trained value for layer %d", i)
+			}
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				trained := normNet.Train(input, target, stepSize, 4, 2)
+				return trained.Apply(input, 4)
+			},
+			V: append([]*anydiff.Var{input, target, stepSize}, realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+}
+
+func TestNetEmbedding(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	realNet, virtualNet := randomNetwork(c)
+	embedNet := *virtualNet
+	embedNet.Embedding = true
+
+	input := anydiff.NewVar(c.MakeVector(12))
+	target := anydiff.NewVar(c.MakeVector(8))
+	stepSize := anydiff.NewVar(c.MakeVectorData([]float64{0.1}))
+	anyvec.Rand(input.Vector, anyvec.Normal, nil)
+	anyvec.Rand(target.Vector, anyvec.Normal, nil)
+	keys := anydiff.Exp(anydiff.LogSoftmax(input, 3))
+
+	t.Run("Value", func(t *testing.T) {
+		// The first layer has no activation.
+		linearNet := append(anynet.Net{realNet[0]}, realNet[2:]...)
+		actual := embedNet.Apply(keys, 4).Output()
+		expected := linearNet.Apply(keys, 4).Output()
+		diff := actual.Copy()
+		diff.Sub(expected)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+		}
+	})
+
+	t.Run("Sparse", func(t *testing.T) {
+		sparseNet := embedNet
+		sparseNet.EmbeddingTopK = 1
+		keyData := vecFloats(keys.Output())
+		oneHot := make([]float64, len(keyData))
+		used := map[int]bool{}
+		for i := 0; i < 4; i++ {
+			var best int
+			for j := 1; j < 3; j++ {
+				if keyData[i*3+j] > keyData[i*3+best] {
+					best = j
+				}
+			}
+			oneHot[i*3+best] = 1
+			used[best] = true
+		}
+
+		actual := sparseNet.Apply(keys, 4).Output()
+		expected := embedNet.Apply(anydiff.NewConst(c.MakeVectorData(oneHot)), 4).Output()
+		diff := actual.Copy()
+		diff.Sub(expected)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", expected.Data(), actual.Data())
+		}
+
+		trained := sparseNet.Train(keys, target, stepSize, 4, 1)
+		oldTable := vecFloats(virtualNet.Parameters.Outputs()[0])
+		newTable := vecFloats(trained.Parameters.Outputs()[0])
+		for i, x := range newTable {
+			symbol := i % 3
+			if changed := x != oldTable[i]; changed != used[symbol] {
+				t.Errorf("symbol %d (used=%v): changed=%v", symbol, used[symbol], changed)
+			}
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		sparseNet := embedNet
+		sparseNet.EmbeddingTopK = 2
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				keys := anydiff.Exp(anydiff.LogSoftmax(input, 3))
+				trained := sparseNet.Train(keys, target, stepSize, 4, 2)
+				return trained.Apply(keys, 4)
+			},
+			V: append([]*anydiff.Var{input, target, stepSize}, realNet.Parameters()...),
+		}
+		checker.FullCheck(t)
+	})
+}
+
 func TestNetBatched(t *testing.T) {
 	c := anyvec64.CurrentCreator()
 	_, net1 := randomNetwork(c)
@@ -0,0 +1,183 @@
+package sgdstore
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anyvec"
+)
+
+// A singularError indicates that one of the systems
+// passed to batchedSolve has a zero or non-finite pivot.
+type singularError struct {
+	// Index is the index of the system in the batch.
+	Index int
+}
+
+func (s *singularError) Error() string {
+	return fmt.Sprintf("singular linear system at index %d", s.Index)
+}
+
+// batchedSolve solves the linear systems A*X = B for a
+// batch of square, invertible matrices A.
+//
+// If some of the matrices are singular, their solutions
+// are set to zero and the first one is reported as a
+// *singularError.
+func batchedSolve(a, b *anydiff.MatrixBatch) (*anydiff.MatrixBatch, error) {
+	if a.Rows != a.Cols || a.Rows != b.Rows || a.Num != b.Num {
+		panic("invalid dimensions for linear system")
+	}
+	aData := vecFloats(a.Data.Output())
+	x, err := solveSystems(aData, vecFloats(b.Data.Output()), a.Num, b.Rows, b.Cols, false)
+	c := b.Data.Output().Creator()
+	return &anydiff.MatrixBatch{
+		Data: &solveRes{
+			A:      a,
+			B:      b,
+			AData:  aData,
+			XData:  x,
+			OutVec: c.MakeVectorData(c.MakeNumericList(x)),
+			V:      anydiff.MergeVarSets(a.Data.Vars(), b.Data.Vars()),
+		},
+		Rows: b.Rows,
+		Cols: b.Cols,
+		Num:  b.Num,
+	}, err
+}
+
+type solveRes struct {
+	A      *anydiff.MatrixBatch
+	B      *anydiff.MatrixBatch
+	AData  []float64
+	XData  []float64
+	OutVec anyvec.Vector
+	V      anydiff.VarSet
+}
+
+func (s *solveRes) Output() anyvec.Vector {
+	return s.OutVec
+}
+
+func (s *solveRes) Vars() anydiff.VarSet {
+	return s.V
+}
+
+func (s *solveRes) Propagate(u anyvec.Vector, g anydiff.Grad) {
+	num, size, cols := s.B.Num, s.B.Rows, s.B.Cols
+	c := u.Creator()
+
+	// If X = A^-1*B, then dB = A^-T*U and dA = -dB*X^T.
+	// Singular systems were already reported by
+	// batchedSolve, and their gradients are zero.
+	bGrad, _ := solveSystems(s.AData, vecFloats(u), num, size, cols, true)
+
+	if g.Intersects(s.A.Data.Vars()) {
+		aGrad := make([]float64, len(s.AData))
+		for i := 0; i < num; i++ {
+			bg := bGrad[i*size*cols : (i+1)*size*cols]
+			x := s.XData[i*size*cols : (i+1)*size*cols]
+			ag := aGrad[i*size*size : (i+1)*size*size]
+			for row := 0; row < size; row++ {
+				for col := 0; col < size; col++ {
+					var sum float64
+					for j := 0; j < cols; j++ {
+						sum += bg[row*cols+j] * x[col*cols+j]
+					}
+					ag[row*size+col] = -sum
+				}
+			}
+		}
+		s.A.Data.Propagate(c.MakeVectorData(c.MakeNumericList(aGrad)), g)
+	}
+	if g.Intersects(s.B.Data.Vars()) {
+		s.B.Data.Propagate(c.MakeVectorData(c.MakeNumericList(bGrad)), g)
+	}
+}
+
+// solveSystems solves a batch of row-major linear systems
+// using Gaussian elimination with partial pivoting.
+//
+// If transpose is true, each matrix in a is transposed
+// before solving.
+//
+// Singular systems have zero solutions, and the first one
+// is reported as a *singularError.
+func solveSystems(a, b []float64, num, size, cols int, transpose bool) ([]float64, error) {
+	var err error
+	res := make([]float64, 0, len(b))
+	for i := 0; i < num; i++ {
+		mat := make([]float64, size*size)
+		copy(mat, a[i*size*size:(i+1)*size*size])
+		if transpose {
+			for row := 0; row < size; row++ {
+				for col := 0; col < row; col++ {
+					idx1, idx2 := row*size+col, col*size+row
+					mat[idx1], mat[idx2] = mat[idx2], mat[idx1]
+				}
+			}
+		}
+		rhs := make([]float64, size*cols)
+		copy(rhs, b[i*size*cols:(i+1)*size*cols])
+		if !solveSystem(mat, rhs, size, cols) {
+			for j := range rhs {
+				rhs[j] = 0
+			}
+			if err == nil {
+				err = &singularError{Index: i}
+			}
+		}
+		res = append(res, rhs...)
+	}
+	return res, err
+}
+
+// solveSystem solves a single linear system in place,
+// leaving the solution in rhs.
+//
+// It returns false if the matrix is singular, in which
+// case rhs is left in an unspecified state.
+func solveSystem(mat, rhs []float64, size, cols int) bool {
+	for col := 0; col < size; col++ {
+		pivot := col
+		for row := col + 1; row < size; row++ {
+			if math.Abs(mat[row*size+col]) > math.Abs(mat[pivot*size+col]) {
+				pivot = row
+			}
+		}
+		pivotVal := mat[pivot*size+col]
+		if pivotVal == 0 || math.IsNaN(pivotVal) || math.IsInf(pivotVal, 0) {
+			return false
+		}
+		if pivot != col {
+			swapRows(mat, size, pivot, col)
+			swapRows(rhs, cols, pivot, col)
+		}
+		for row := col + 1; row < size; row++ {
+			scale := mat[row*size+col] / mat[col*size+col]
+			for j := col; j < size; j++ {
+				mat[row*size+j] -= scale * mat[col*size+j]
+			}
+			for j := 0; j < cols; j++ {
+				rhs[row*cols+j] -= scale * rhs[col*cols+j]
+			}
+		}
+	}
+	for row := size - 1; row >= 0; row-- {
+		for j := 0; j < cols; j++ {
+			sum := rhs[row*cols+j]
+			for k := row + 1; k < size; k++ {
+				sum -= mat[row*size+k] * rhs[k*cols+j]
+			}
+			rhs[row*cols+j] = sum / mat[row*size+row]
+		}
+	}
+	return true
+}
+
+func swapRows(mat []float64, cols, r1, r2 int) {
+	for j := 0; j < cols; j++ {
+		mat[r1*cols+j], mat[r2*cols+j] = mat[r2*cols+j], mat[r1*cols+j]
+	}
+}
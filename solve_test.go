@@ -0,0 +1,78 @@
+package sgdstore
+
+import (
+	"testing"
+
+	"github.com/unixpickle/anydiff"
+	"github.com/unixpickle/anydiff/anydifftest"
+	"github.com/unixpickle/anyvec"
+	"github.com/unixpickle/anyvec/anyvec64"
+)
+
+func TestBatchedSolve(t *testing.T) {
+	c := anyvec64.CurrentCreator()
+	a := anydiff.NewVar(c.MakeVector(2 * 3 * 3))
+	b := anydiff.NewVar(c.MakeVector(2 * 3 * 2))
+	anyvec.Rand(a.Vector, anyvec.Normal, nil)
+	anyvec.Rand(b.Vector, anyvec.Normal, nil)
+
+	// Make the matrices well-conditioned.
+	a.Vector.Add(c.MakeVectorData([]float64{
+		3, 0, 0, 0, 3, 0, 0, 0, 3,
+		3, 0, 0, 0, 3, 0, 0, 0, 3,
+	}))
+
+	aMat := &anydiff.MatrixBatch{Data: a, Rows: 3, Cols: 3, Num: 2}
+	bMat := &anydiff.MatrixBatch{Data: b, Rows: 3, Cols: 2, Num: 2}
+
+	t.Run("Value", func(t *testing.T) {
+		x, err := batchedSolve(aMat, bMat)
+		if err != nil {
+			t.Fatal(err)
+		}
+		product := anydiff.BatchedMatMul(false, false, aMat, x).Data.Output()
+		diff := product.Copy()
+		diff.Sub(b.Vector)
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("expected %v but got %v", b.Vector.Data(), product.Data())
+		}
+	})
+
+	t.Run("Gradients", func(t *testing.T) {
+		checker := &anydifftest.ResChecker{
+			F: func() anydiff.Res {
+				x, _ := batchedSolve(aMat, bMat)
+				return x.Data
+			},
+			V: []*anydiff.Var{a, b},
+		}
+		checker.FullCheck(t)
+	})
+
+	t.Run("Singular", func(t *testing.T) {
+		singular := vecFloats(a.Vector)
+		for i := 9; i < 18; i++ {
+			singular[i] = 0
+		}
+		sMat := &anydiff.MatrixBatch{
+			Data: anydiff.NewConst(c.MakeVectorData(singular)),
+			Rows: 3,
+			Cols: 3,
+			Num:  2,
+		}
+		x, err := batchedSolve(sMat, bMat)
+		if err, ok := err.(*singularError); !ok || err.Index != 1 {
+			t.Fatalf("unexpected error: %v", err)
+		}
+		expected, _ := batchedSolve(aMat, bMat)
+		actual := x.Data.Output()
+		diff := actual.Slice(0, 6).Copy()
+		diff.Sub(expected.Data.Output().Slice(0, 6))
+		if anyvec.AbsMax(diff).(float64) > 1e-4 {
+			t.Errorf("bad solution for the first system: %v", actual.Data())
+		}
+		if anyvec.AbsMax(actual.Slice(6, 12)).(float64) != 0 {
+			t.Errorf("expected zero solution for the second system: %v", actual.Data())
+		}
+	})
+}
@@ -0,0 +1,148 @@
+package sgdstore
+
+import "github.com/unixpickle/anynet/anyrnn"
+
+// FindBlocks finds every Block in an RNN, searching
+// recursively through anyrnn.Stack, anyrnn.Parallel, and
+// anyrnn.Feedback blocks.
+// For a DualBlock, the fast Block is included.
+// Use FindDualBlocks to reach the slow memory settings.
+// For a ContextBlock, the wrapped Block is included.
+func FindBlocks(root anyrnn.Block) []*Block {
+	var res []*Block
+	walkBlocks(root, func(b anyrnn.Block) {
+		switch b := b.(type) {
+		case *Block:
+			res = append(res, b)
+		case *DualBlock:
+			res = append(res, b.Fast)
+		case *ContextBlock:
+			res = append(res, b.Block)
+		}
+	})
+	return res
+}
+
+// FindDualBlocks is like FindBlocks, but it finds every
+// DualBlock in an RNN.
+func FindDualBlocks(root anyrnn.Block) []*DualBlock {
+	var res []*DualBlock
+	walkBlocks(root, func(b anyrnn.Block) {
+		if b, ok := b.(*DualBlock); ok {
+			res = append(res, b)
+		}
+	})
+	return res
+}
+
+// MapBlocks returns a copy of an RNN in which every leaf
+// block b is replaced with f(b), searching through the
+// same containers as FindBlocks.
+// The containers are copied, so root is not modified,
+// but the leaf blocks are shared with root.
+func MapBlocks(root anyrnn.Block, f func(b anyrnn.Block) anyrnn.Block) anyrnn.Block {
+	switch root := root.(type) {
+	case anyrnn.Stack:
+		res := make(anyrnn.Stack, len(root))
+		for i, b := range root {
+			res[i] = MapBlocks(b, f)
+		}
+		return res
+	case *anyrnn.Parallel:
+		res := *root
+		res.Block1 = MapBlocks(root.Block1, f)
+		res.Block2 = MapBlocks(root.Block2, f)
+		return &res
+	case *anyrnn.Feedback:
+		res := *root
+		res.Block = MapBlocks(root.Block, f)
+		return &res
+	default:
+		return f(root)
+	}
+}
+
+// OverrideSteps changes the number of SGD steps and
+// scales the step sizes of every Block in an RNN.
+// This is useful for evaluating a model with different
+// settings than it was trained with.
+//
+// For Blocks with adaptive computation, MaxSteps is
+// changed instead of Steps.
+// If steps is 0, the number of steps is not changed.
+//
+// Each Block's StepSizeScale is multiplied by stepScale,
+// so a Block that already scales its step sizes keeps
+// doing so.
+// If stepScale is 0, the step sizes are not changed.
+//
+// For DualBlocks, SlowStepSize is multiplied by
+// stepScale, but DistillSteps is left alone, since it
+// controls consolidation rather than writes.
+//
+// The returned function restores the original settings.
+func OverrideSteps(root anyrnn.Block, steps int, stepScale float64) (restore func()) {
+	blocks := FindBlocks(root)
+	oldSteps := make([]int, len(blocks))
+	oldScales := make([]float64, len(blocks))
+	for i, b := range blocks {
+		oldScales[i] = b.StepSizeScale
+		if stepScale != 0 {
+			if b.StepSizeScale == 0 {
+				b.StepSizeScale = stepScale
+			} else {
+				b.StepSizeScale *= stepScale
+			}
+		}
+		if b.MaxSteps != 0 {
+			oldSteps[i] = b.MaxSteps
+			if steps != 0 {
+				b.MaxSteps = steps
+			}
+		} else {
+			oldSteps[i] = b.Steps
+			if steps != 0 {
+				b.Steps = steps
+			}
+		}
+	}
+	duals := FindDualBlocks(root)
+	oldSlowSizes := make([]float64, len(duals))
+	for i, d := range duals {
+		oldSlowSizes[i] = d.SlowStepSize
+		if stepScale != 0 {
+			d.SlowStepSize *= stepScale
+		}
+	}
+	return func() {
+		for i, d := range duals {
+			d.SlowStepSize = oldSlowSizes[i]
+		}
+		for i, b := range blocks {
+			b.StepSizeScale = oldScales[i]
+			if b.MaxSteps != 0 {
+				b.MaxSteps = oldSteps[i]
+			} else {
+				b.Steps = oldSteps[i]
+			}
+		}
+	}
+}
+
+// walkBlocks calls f for every leaf block in an RNN,
+// searching through the same containers as FindBlocks.
+func walkBlocks(root anyrnn.Block, f func(b anyrnn.Block)) {
+	switch root := root.(type) {
+	case anyrnn.Stack:
+		for _, b := range root {
+			walkBlocks(b, f)
+		}
+	case *anyrnn.Parallel:
+		walkBlocks(root.Block1, f)
+		walkBlocks(root.Block2, f)
+	case *anyrnn.Feedback:
+		walkBlocks(root.Block, f)
+	default:
+		f(root)
+	}
+}